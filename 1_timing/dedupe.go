@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// WithDedupe coalesces requests for the same URL: MultiURLTime gets every URL once and
+// copies the Result to its duplicates, and concurrent calls for a URL that is already
+// being requested with the same options wait for that request and share its Result.
+// Only successful Results are shared, a waiter whose shared request failed (e.g. because
+// the other caller's context was cancelled) makes its own request. Only plain GETs
+// (URLTime and friends) are coalesced.
+func WithDedupe() Option {
+	return func(o *options) {
+		o.dedupe = true
+	}
+}
+
+// inflight coalesces concurrent WithDedupe requests.
+var inflight flightGroup
+
+// dedupeKey identifies the requests for url with the options that change their Result.
+func dedupeKey(url string, o options) string {
+	// fmt prints maps with sorted keys, so equal headers give equal keys
+	return fmt.Sprintf("%s|%p|%t|%t|%t|%d|%v",
+		url, o.client, o.sha256, o.compression, o.noFollow, o.maxBody, o.header)
+}
+
+// flightGroup runs at most one function per key at a time, callers with the same
+// key arriving while it runs get its result (a minimal x/sync/singleflight).
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{} // closed once r is set
+	r    Result
+}
+
+// do returns the result of fn, or the successful result of the fn already running
+// for key. If that one fails, fn is called. A waiter stops waiting once ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() Result) Result {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			if f.r.Err == nil {
+				return f.r
+			}
+		case <-ctx.Done():
+		}
+		return fn()
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.r = fn()
+	return f.r
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Validators remembers the ETag and Last-Modified headers of downloaded URLs, so later
+// downloads can skip unchanged content. It's safe for concurrent use.
+type Validators struct {
+	mu sync.Mutex
+	m  map[string]validator
+}
+
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+// NewValidators returns an empty Validators.
+func NewValidators() *Validators {
+	return &Validators{m: make(map[string]validator)}
+}
+
+// WithValidators makes DownloadAll send conditional requests using v, and record
+// validators of new downloads in v. A 304 reply is reported as Result.Unchanged.
+func WithValidators(v *Validators) Option {
+	return func(o *options) {
+		o.validators = v
+	}
+}
+
+// WithFileTimeout limits how long DownloadAll spends on every single URL, so a stalled
+// download fails with KindTimeout and the worker moves on. 0 (the default) means no limit,
+// the context passed to DownloadAll still bounds the whole download.
+func WithFileTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.fileTimeout = d
+	}
+}
+
+// WithChecksums makes DownloadAll verify downloads against sums, which maps file names
+// (see DownloadAll) to the hex SHA1 of their content. Files not in sums aren't checked.
+// A mismatch fails the Result with KindChecksum, and if remove is set the download is
+// discarded instead of written.
+func WithChecksums(sums map[string]string, remove bool) Option {
+	return func(o *options) {
+		o.checksums = sums
+		o.removeBad = remove
+	}
+}
+
+// apply sets the conditional headers for req from a previous download of url.
+func (v *Validators) apply(url string, req *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	val, ok := v.m[url]
+	if !ok {
+		return
+	}
+	if val.etag != "" {
+		req.Header.Set("If-None-Match", val.etag)
+	}
+	if val.lastModified != "" {
+		req.Header.Set("If-Modified-Since", val.lastModified)
+	}
+}
+
+// store records the validators in resp for url.
+func (v *Validators) store(url string, resp *http.Response) {
+	val := validator{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if val == (validator{}) {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.m[url] = val
+}
+
+// fileName returns the name to save rawURL to, the last element of its path.
+func fileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "index"
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "index"
+	}
+	return name
+}
+
+// DownloadAll gets every URL in urls and writes its body to destDir/<basename of URL>.
+// destDir is created if needed and at most workers downloads run at once.
+// A URL with the same basename as a previous one fails instead of overwriting it.
+// Results are in the same order as urls.
+func DownloadAll(ctx context.Context, urls []string, destDir string, workers int, opts ...Option) []Result {
+	o := newOptions(opts)
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]Result, len(urls))
+	if err := os.MkdirAll(destDir, 0750); err != nil {
+		for i, u := range urls {
+			results[i] = Result{URL: u, Err: err, Kind: classify(err)}
+		}
+		return results
+	}
+
+	// index in urls of the first URL saved to every file name
+	names := make(map[string]int, len(urls))
+	dup := make([]bool, len(urls))
+	for i, u := range urls {
+		name := fileName(u)
+		if j, ok := names[name]; ok {
+			err := fmt.Errorf("%q: same file name as %s", name, urls[j])
+			results[i] = Result{URL: u, Err: err, Kind: KindOther}
+			dup[i] = true
+			continue
+		}
+		names[name] = i
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = download(ctx, urls[i], destDir, o)
+			}
+		}()
+	}
+
+	tick, stop := pacer(o.rate)
+	defer stop()
+	sent := 0
+	for i := range urls {
+		if dup[i] {
+			continue
+		}
+		if tick != nil && sent > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		jobs <- i
+		sent++
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// download gets url and writes its body to destDir.
+func download(ctx context.Context, url, destDir string, o options) Result {
+	start := time.Now()
+	r := Result{URL: url}
+	failed := func(err error, kind ErrorKind) Result {
+		o.logger.Error("download failed", "url", url, "error", err)
+		r.Err, r.Kind = err, kind
+		r.Duration = time.Since(start)
+		return r
+	}
+
+	if o.fileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.fileTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return failed(err, classify(err))
+	}
+	o.setHeaders(req)
+	if o.validators != nil {
+		o.validators.apply(url, req)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return failed(err, classify(err))
+	}
+	defer resp.Body.Close()
+
+	r.Status = resp.StatusCode
+	r.ContentType = resp.Header.Get("Content-Type")
+	if resp.StatusCode == http.StatusNotModified && o.validators != nil {
+		r.Unchanged = true
+		r.Duration = time.Since(start)
+		o.logger.Info("unchanged", "url", url, "duration", r.Duration)
+		return r
+	}
+	if resp.StatusCode != http.StatusOK {
+		return failed(fmt.Errorf("bad status - %s", resp.Status), KindStatus)
+	}
+
+	// The body goes to a hidden file first, so a failed download neither leaves a
+	// partial file nor replaces the previous version.
+	path := filepath.Join(destDir, fileName(url))
+	tmp, sum, err := spool(destDir, fileName(url), resp.Body, &r.Bytes)
+	if err != nil {
+		return failed(err, classify(err))
+	}
+
+	var sumErr error
+	if want, ok := o.checksums[fileName(url)]; ok {
+		if got := hex.EncodeToString(sum); got != want {
+			sumErr = fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+		}
+	}
+	if sumErr != nil && o.removeBad {
+		os.Remove(tmp)
+		return failed(sumErr, KindChecksum)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return failed(err, classify(err))
+	}
+	r.Path = path
+	if sumErr != nil {
+		return failed(sumErr, KindChecksum)
+	}
+
+	if o.validators != nil {
+		o.validators.store(url, resp)
+	}
+
+	r.Duration = time.Since(start)
+	o.logger.Info("downloaded", "url", url, "path", r.Path, "bytes", r.Bytes, "duration", r.Duration)
+	return r
+}
+
+// spool copies body to a new hidden file in dir, named after name, counting the bytes
+// copied in n. It returns the path of the file, to be renamed or removed by the caller,
+// and the SHA1 of its content. The file gets the usual 0644 permissions instead of the
+// owner only ones of os.CreateTemp. On error nothing is left in dir.
+func spool(dir, name string, body io.Reader, n *int64) (string, []byte, error) {
+	file, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := sha1.New()
+	*n, err = io.Copy(io.MultiWriter(file, h), body)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", nil, err
+	}
+	return file.Name(), h.Sum(nil), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import "net/http"
+
+// WithHeaders adds h to every request, e.g. an Authorization or X-Api-Key header.
+// Values of sensitive headers are redacted in logs.
+func WithHeaders(h http.Header) Option {
+	return func(o *options) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		for k, vs := range h {
+			for _, v := range vs {
+				o.header.Add(k, v)
+			}
+		}
+	}
+}
+
+// WithHeader adds the header key: value to every request, e.g.
+// WithHeader("User-Agent", "timing/1.0"). It can be used several times.
+func WithHeader(key, value string) Option {
+	return WithHeaders(http.Header{http.CanonicalHeaderKey(key): {value}})
+}
+
+// setHeaders sets the headers from WithHeaders on req, replacing existing values.
+func (o options) setHeaders(req *http.Request) {
+	for k, vs := range o.header {
+		req.Header[k] = vs
+	}
+}
+
+// sensitiveHeaders are the headers whose values are not logged.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+}
+
+// redacted returns a copy of h that is safe to log.
+func redacted(h http.Header) http.Header {
+	safe := h.Clone()
+	for k := range safe {
+		if sensitiveHeaders[http.CanonicalHeaderKey(k)] {
+			safe[k] = []string{"REDACTED"}
+		}
+	}
+	return safe
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WaitHealthy probes url every interval until it replies 200 OK, or ctx is done.
+// Failed connections and other statuses are retried. It returns ctx error if url
+// didn't become healthy in time, or an error right away if interval isn't positive.
+func WaitHealthy(ctx context.Context, url string, interval time.Duration, opts ...Option) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r := URLTimeCtx(ctx, url, opts...)
+		if r.Err == nil && r.Status == http.StatusOK {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Monitor requests url right away and then every interval, sending every Result on the
+// returned channel, until ctx is done. The channel is closed once monitoring stopped.
+// A slow receiver delays the following requests, it doesn't queue them.
+// If interval isn't positive, nothing is requested and the channel is closed right away.
+func Monitor(ctx context.Context, url string, interval time.Duration, opts ...Option) <-chan Result {
+	out := make(chan Result)
+	if interval <= 0 {
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			r := URLTimeCtx(ctx, url, opts...)
+			if ctx.Err() != nil { // the Result would only report the cancellation
+				return
+			}
+
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ReadURLs returns the URLs in r, one per line. Blank lines and lines starting with #
+// are skipped. URLs must be absolute, the error of the first bad one has its line number.
+func ReadURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	s := bufio.NewScanner(r)
+	for lnum := 1; s.Scan(); lnum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", lnum, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("%d: %q: not an absolute URL", lnum, line)
+		}
+		urls = append(urls, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// readURLsFile is ReadURLs from the file at path, "-" means standard input.
+func readURLsFile(path string) ([]string, error) {
+	if path == "-" {
+		return ReadURLs(os.Stdin)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := ReadURLs(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return urls, nil
+}
@@ -1,48 +1,563 @@
 package main
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
-// MutliURLTimes calls URLTime for every URL in URLs.
-func MultiURLTime(urls []string) {
-	wg := sync.WaitGroup{}
-	wg.Add(len(urls))
+// MultiURLTime calls URLTime concurrently for every URL in urls and returns the results,
+// in the order of urls. With WithRate, calls are started at most rate times per second.
+func MultiURLTime(urls []string, opts ...Option) []Result {
+	return MultiURLTimeCtx(context.Background(), urls, opts...)
+}
+
+// MultiURLTimeCtx is MultiURLTime with every call using ctx. URLs not started before
+// ctx is done get a Result with ctx error.
+func MultiURLTimeCtx(ctx context.Context, urls []string, opts ...Option) []Result {
+	return multiURLTime(ctx, urls, len(urls), opts)
+}
+
+// MultiURLTimeClient is MultiURLTime using client, nil means http.DefaultClient.
+func MultiURLTimeClient(client *http.Client, urls []string, opts ...Option) []Result {
+	return MultiURLTime(urls, append(opts, WithClient(client))...)
+}
+
+// MultiURLTimeBudget is MultiURLTime that must finish within total, the deadline is
+// shared by all URLs. URLs not done in time get a KindTimeout Result with a
+// context.DeadlineExceeded error.
+func MultiURLTimeBudget(urls []string, total time.Duration, opts ...Option) []Result {
+	ctx, cancel := context.WithTimeout(context.Background(), total)
+	defer cancel()
+
+	return MultiURLTimeCtx(ctx, urls, opts...)
+}
+
+// MultiURLTimeN is MultiURLTime with at most workers calls running at once.
+func MultiURLTimeN(urls []string, workers int, opts ...Option) []Result {
+	return multiURLTime(context.Background(), urls, workers, opts)
+}
+
+// MultiURLTimeStream is MultiURLTime with at most concurrency calls running at once,
+// sending every Result on the returned channel as soon as it's ready, in completion order.
+// The channel is closed after the last Result, or soon after ctx is done, in which case
+// not all URLs get a Result.
+func MultiURLTimeStream(ctx context.Context, urls []string, concurrency int, opts ...Option) <-chan Result {
+	o := newOptions(opts)
+	workers := min(max(concurrency, 1), max(len(urls), 1))
+
+	out := make(chan Result)
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for url := range jobs {
+				r := URLTimeCtx(ctx, url, opts...)
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		defer close(jobs)
 
-	for _, url := range urls {
-		go func(url string) {
+		tick, stop := pacer(o.rate)
+		defer stop()
+
+		for i, url := range urls {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- url:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// pacer returns a channel to receive from between requests to start at most rate
+// requests per second, and a function to release it. The channel is nil if rate <= 0 or
+// so high that the interval rounds to 0, callers must check for nil since receiving
+// from it blocks forever.
+func pacer(rate float64) (<-chan time.Time, func()) {
+	if rate <= 0 {
+		return nil, func() {}
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 { // rate > 1e9, or +Inf
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// multiURLTime feeds urls to a pool of workers goroutines calling URLTimeCtx.
+func multiURLTime(ctx context.Context, urls []string, workers int, opts []Option) []Result {
+	o := newOptions(opts)
+	workers = min(max(workers, 1), len(urls))
+
+	tick, stop := pacer(o.rate)
+	defer stop()
+
+	results := make([]Result, len(urls))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
 			defer wg.Done()
-			URLTime(url)
-		}(url)
+			for i := range jobs {
+				results[i] = URLTimeCtx(ctx, urls[i], opts...)
+			}
+		}()
+	}
+
+	first := make(map[string]int) // WithDedupe: index of the first occurrence of every URL
+	for i, url := range urls {
+		if o.dedupe {
+			if _, ok := first[url]; ok {
+				continue
+			}
+			first[url] = i
+		}
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, url := range urls {
+		if j, ok := first[url]; ok && j != i {
+			results[i] = results[j]
+		}
+	}
+	return results
+}
+
+// ErrorKind classifies why a URL check failed.
+type ErrorKind int
+
+const (
+	KindNone     ErrorKind = iota // no error
+	KindDNS                       // host name lookup failed
+	KindRefused                   // connection refused
+	KindTimeout                   // deadline exceeded
+	KindStatus                    // non-200 status
+	KindChecksum                  // downloaded content doesn't match its checksum
+	KindOther                     // anything else
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNone:
+		return "none"
+	case KindDNS:
+		return "dns"
+	case KindRefused:
+		return "refused"
+	case KindTimeout:
+		return "timeout"
+	case KindStatus:
+		return "status"
+	case KindChecksum:
+		return "checksum"
+	}
+	return "other"
+}
+
+// classify returns the ErrorKind of err.
+func classify(err error) ErrorKind {
+	if err == nil {
+		return KindNone
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return KindDNS
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return KindTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return KindRefused
+	}
+	// *url.Error and friends
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return KindTimeout
+	}
+	return KindOther
+}
+
+// Result is the outcome of checking a URL.
+type Result struct {
+	URL      string
+	Duration time.Duration
+	Status   int
+	Err      error
+	Kind     ErrorKind
+	SHA256   string // hex digest of the body, set only WithSHA256
+	Bytes    int64  // body size, after decompression WithCompression
+	Path     string // file the body was written to, set by DownloadAll
+	// ContentType is the Content-Type header of the response.
+	ContentType string
+	// FinalURL is the URL of the response after following redirects, and Redirects
+	// the number of redirects followed.
+	FinalURL  string
+	Redirects int
+	// Truncated is set when only the first WithMaxBodyBytes of the body were read.
+	Truncated bool
+	TLS       *TLSInfo // nil for plain HTTP
+	// Unchanged is set by DownloadAll WithValidators when the server replied
+	// 304 Not Modified, nothing was written.
+	Unchanged bool
+	Attempts  int // number of tries, set by URLTimeRetry
+	// Body sizes as transferred and after decompression, set only WithCompression.
+	// They are equal when the server didn't compress the body.
+	CompressedBytes   int64
+	DecompressedBytes int64
+}
+
+type options struct {
+	sha256   bool
+	client   *http.Client
+	noFollow bool
+	rate     float64
+	logger   *slog.Logger
+	// validators for conditional downloads, nil means download unconditionally
+	validators  *Validators
+	fileTimeout time.Duration // per URL DownloadAll timeout, 0 means none
+	checksums   map[string]string
+	removeBad   bool
+	compression bool
+	header      http.Header // added to every request
+	dedupe      bool
+	slow        time.Duration
+	onSlow      func(Result)
+	maxBody     int64
+}
+
+// newOptions returns the default options with opts applied.
+func newOptions(opts []Option) options {
+	o := options{
+		client: http.DefaultClient,
+		logger: slog.New(slog.DiscardHandler),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Option configures URLTime.
+type Option func(*options)
+
+// WithSHA256 computes the SHA256 of the response body while it's read.
+func WithSHA256() Option {
+	return func(o *options) {
+		o.sha256 = true
+	}
+}
+
+// WithFollowRedirects sets if redirects are followed (the default), Result.Redirects
+// counts them. When not following, the redirect response itself is timed and a 3xx
+// status is not an error.
+func WithFollowRedirects(follow bool) Option {
+	return func(o *options) {
+		o.noFollow = !follow
+	}
+}
+
+// WithCompression asks for a gzip or deflate compressed body and decompresses it while
+// reading, reporting both sizes in Result.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compression = true
+	}
+}
+
+// WithMaxBodyBytes reads at most n bytes of the body, so large responses don't inflate
+// the duration. 0 (the default) reads the whole body.
+func WithMaxBodyBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBody = n
+	}
+}
+
+// WithSlowCallback calls fn with every successful Result slower than threshold.
+// fn is called in a new goroutine so it doesn't delay measurements, it must be safe
+// for concurrent use.
+func WithSlowCallback(threshold time.Duration, fn func(Result)) Option {
+	return func(o *options) {
+		o.slow = threshold
+		o.onSlow = fn
+	}
+}
+
+// WithClient sets the client used for requests, nil means http.DefaultClient (the default).
+func WithClient(client *http.Client) Option {
+	return func(o *options) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		o.client = client
+	}
+}
+
+// WithLogger sets the logger, by default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRate limits MultiURLTime, its variants and DownloadAll to start at most rate
+// requests per second, whatever the number of workers. 0 means no limit.
+func WithRate(rate float64) Option {
+	return func(o *options) {
+		o.rate = rate
 	}
 }
 
 // URLTime checks how much time it takes url to respond.
-func URLTime(url string) {
+func URLTime(url string, opts ...Option) Result {
+	return URLTimeCtx(context.Background(), url, opts...)
+}
+
+// URLTimeClient is URLTime using client, nil means http.DefaultClient.
+func URLTimeClient(client *http.Client, url string, opts ...Option) Result {
+	return URLTime(url, append(opts, WithClient(client))...)
+}
+
+// URLTimeCtx is URLTime with the request bound to ctx, so the caller controls the deadline.
+// If ctx is done before the response is read, the Result has the context error.
+func URLTimeCtx(ctx context.Context, url string, opts ...Option) Result {
+	o := newOptions(opts)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Result{URL: url, Err: err, Kind: KindOther}
+	}
+	if o.dedupe {
+		return inflight.do(ctx, dedupeKey(url, o), func() Result { return urlTime(req, url, o) })
+	}
+	return urlTime(req, url, o)
+}
+
+// URLTimeReq is URLTime for any request, e.g. a POST with a body and headers.
+// The request context controls the deadline. req is not modified.
+func URLTimeReq(req *http.Request, opts ...Option) Result {
+	return urlTime(req, req.URL.String(), newOptions(opts))
+}
+
+// urlTime times req, url is used in the Result and logs.
+func urlTime(req *http.Request, url string, o options) Result {
 	start := time.Now()
+	r := Result{URL: url}
+
+	client := o.client
+	if o.noFollow {
+		c := *client
+		c.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		client = &c
+	}
 
-	resp, err := http.Get(url)
+	if o.compression || len(o.header) > 0 {
+		req = req.Clone(req.Context()) // don't modify the caller request
+		o.setHeaders(req)
+		if o.compression {
+			// setting it ourselves disables the transport transparent gzip handling
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+	}
+	o.logger.Debug("request", "method", req.Method, "url", url, "header", redacted(req.Header))
+
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("error: %q - %s", url, err)
-		return
+		o.logger.Error("request failed", "url", url, "error", err)
+		r.Err, r.Kind = err, classify(err)
+		return r
+	}
+	defer resp.Body.Close()
+
+	r.Status = resp.StatusCode
+	r.ContentType = resp.Header.Get("Content-Type")
+	r.FinalURL = resp.Request.URL.String()
+	r.TLS = tlsInfo(resp.TLS)
+	// every followed redirect response links to the request that caused it
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		r.Redirects++
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("error: %q - bad status - %s", url, resp.Status)
-		return
+	redirect := resp.StatusCode >= 300 && resp.StatusCode < 400
+	if resp.StatusCode != http.StatusOK && !(o.noFollow && redirect) {
+		o.logger.Error("bad status", "url", url, "status", resp.Status)
+		r.Err, r.Kind = fmt.Errorf("bad status - %s", resp.Status), KindStatus
+		return r
 	}
 	// Read body
-	_, err = io.Copy(io.Discard, resp.Body)
+	var w io.Writer = io.Discard
+	var h hash.Hash
+	if o.sha256 {
+		h = sha256.New()
+		w = h
+	}
+	compressed := &countingReader{r: resp.Body}
+	var body io.Reader = compressed
+	if o.compression {
+		body, err = decompress(compressed, resp.Header.Get("Content-Encoding"))
+		if err != nil {
+			o.logger.Error("bad body", "url", url, "error", err)
+			r.Err, r.Kind = err, KindOther
+			return r
+		}
+	}
+	if o.maxBody > 0 {
+		r.Bytes, err = io.Copy(w, io.LimitReader(body, o.maxBody))
+		if err == nil && r.Bytes == o.maxBody {
+			var b [1]byte
+			n, _ := io.ReadFull(body, b[:]) // more to read?
+			r.Truncated = n > 0
+		}
+	} else {
+		r.Bytes, err = io.Copy(w, body)
+	}
 	if err != nil {
-		log.Printf("error: %q - %s", url, err)
-		return
+		o.logger.Error("read failed", "url", url, "error", err)
+		r.Err, r.Kind = err, classify(err)
+		return r
+	}
+	if o.compression {
+		r.CompressedBytes, r.DecompressedBytes = compressed.n, r.Bytes
+	}
+	if h != nil {
+		r.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
 	}
 
-	duration := time.Since(start)
-	log.Printf("info: %q - %v", url, duration)
+	r.Duration = time.Since(start)
+	o.logger.Info("done", "url", url, "duration", r.Duration, "bytes", r.Bytes)
+	if o.onSlow != nil && r.Duration > o.slow {
+		o.logger.Warn("slow", "url", url, "duration", r.Duration, "threshold", o.slow)
+		go o.onSlow(r)
+	}
+	return r
+}
+
+// URLTimeRetry is URLTime that tries up to attempts times while the request fails to
+// connect or the server replies with a 5xx status. Other failures, like 4xx, are not
+// retried. Waits between tries start at baseDelay and double every time, with jitter.
+// The Result is the one of the last try.
+func URLTimeRetry(url string, attempts int, baseDelay time.Duration, opts ...Option) Result {
+	attempts = max(attempts, 1)
+	delay := baseDelay
+
+	var r Result
+	for i := 1; i <= attempts; i++ {
+		r = URLTime(url, opts...)
+		r.Attempts = i
+		if !retryable(r) || i == attempts {
+			break
+		}
+
+		// wait between delay/2 and delay so clients don't retry in lockstep
+		time.Sleep(delay/2 + rand.N(delay/2+1))
+		delay *= 2
+	}
+	return r
+}
+
+// retryable reports if r is a transient failure worth retrying.
+func retryable(r Result) bool {
+	if r.Err == nil {
+		return false
+	}
+	if r.Status == 0 { // no response, connection failed
+		return true
+	}
+	return r.Status >= 500
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompress returns a reader decoding r according to its Content-Encoding.
+func decompress(r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return r, nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate": // zlib wrapped, per RFC 9110
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %q", encoding)
+}
+
+// Benchmark calls URLTime samples times on url and returns the results. It first does
+// warmup calls whose results are discarded. All calls share a keep-alive client so
+// the samples don't pay for connection setup, unless WithClient or WithTransport set
+// another one.
+func Benchmark(url string, samples, warmup int, opts ...Option) []Result {
+	if newOptions(opts).client == http.DefaultClient {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		client := &http.Client{Transport: transport}
+		defer client.CloseIdleConnections()
+
+		opts = append(opts, WithClient(client))
+	}
+	for i := 0; i < warmup; i++ {
+		URLTime(url, opts...)
+	}
+
+	results := make([]Result, 0, samples)
+	for i := 0; i < samples; i++ {
+		results = append(results, URLTime(url, opts...))
+	}
+	return results
 }
 
 func main() {
@@ -54,8 +569,24 @@ func main() {
 		"http://localhost:8080/50",
 	}
 
-	MultiURLTime(urls)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	if len(os.Args) > 1 { // file of URLs, "-" for stdin
+		var err error
+		urls, err = readURLsFile(os.Args[1])
+		if err != nil {
+			logger.Error("can't read URLs", "error", err)
+			os.Exit(1)
+		}
+	}
+	// results are in urls order, whichever finished first
+	for _, r := range MultiURLTime(urls) {
+		if r.Err != nil {
+			logger.Error("failed", "url", r.URL, "kind", r.Kind, "error", r.Err)
+			continue
+		}
+		logger.Info("done", "url", r.URL, "status", r.Status, "duration", r.Duration)
+	}
 
 	duration := time.Since(start)
-	log.Printf("%d URLs in %v", len(urls), duration)
+	logger.Info("finished", "urls", len(urls), "duration", duration)
 }
@@ -0,0 +1,927 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	body     = "hello, timing"
+	slowTime = 200 * time.Millisecond
+)
+
+// testServer serves the paths used by the tests and counts the requests to each one.
+type testServer struct {
+	*httptest.Server
+	hits    sync.Map // path -> *atomic.Int64
+	running atomic.Int64
+	peak    atomic.Int64
+}
+
+func (s *testServer) count(path string) *atomic.Int64 {
+	n, _ := s.hits.LoadOrStore(path, new(atomic.Int64))
+	return n.(*atomic.Int64)
+}
+
+// url returns the URL of path on the server.
+func (s *testServer) url(path string) string {
+	return s.URL + path
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &testServer{}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	})
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		n := s.running.Add(1)
+		defer s.running.Add(-1)
+		for p := s.peak.Load(); n > p && !s.peak.CompareAndSwap(p, n); p = s.peak.Load() {
+		}
+
+		select {
+		case <-time.After(slowTime):
+			io.WriteString(w, body)
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if s.count("/flaky").Load() <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, body)
+	})
+	mux.HandleFunc("/gzip", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, strings.Repeat(body, 100))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		io.WriteString(gw, strings.Repeat(body, 100))
+		gw.Close()
+	})
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Test"))
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, body)
+	})
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.count(r.URL.Path).Add(1)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// refusedURL returns the URL of a server that's no longer listening.
+func refusedURL(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	ln.Close()
+	return url
+}
+
+func TestErrorKind(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name    string
+		url     string
+		timeout time.Duration
+		kind    ErrorKind
+	}{
+		{"bad status", s.url("/missing"), time.Second, KindStatus},
+		{"timeout", s.url("/slow"), 20 * time.Millisecond, KindTimeout},
+		{"refused", refusedURL(t), time.Second, KindRefused},
+		{"dns", "http://no-such-host.invalid", 5 * time.Second, KindDNS},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+
+			r := URLTimeCtx(ctx, tc.url)
+			if r.Err == nil || r.Kind != tc.kind {
+				t.Fatalf("kind = %v (%v), want %v", r.Kind, r.Err, tc.kind)
+			}
+		})
+	}
+}
+
+// sha256Hex returns the hex SHA256 of s, as reported WithSHA256.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSHA256(t *testing.T) {
+	s := newTestServer(t)
+
+	if r := URLTime(s.url("/ok"), WithSHA256()); r.SHA256 != sha256Hex(body) {
+		t.Fatalf("SHA256 = %s", r.SHA256)
+	}
+	if r := URLTime(s.url("/ok")); r.SHA256 != "" {
+		t.Fatal("SHA256 set without WithSHA256")
+	}
+}
+
+func TestBenchmarkWarmup(t *testing.T) {
+	s := newTestServer(t)
+
+	results := Benchmark(s.url("/ok"), 3, 2)
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3", len(results))
+	}
+	if n := s.count("/ok").Load(); n != 5 {
+		t.Fatalf("%d requests, want 5", n)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	s := newTestServer(t)
+
+	if r := URLTime(s.url("/redirect")); r.Err != nil || r.Status != http.StatusOK {
+		t.Fatalf("follow: %+v", r)
+	}
+
+	s.count("/ok").Store(0)
+	r := URLTime(s.url("/redirect"), WithFollowRedirects(false))
+	if r.Err != nil || r.Status != http.StatusFound {
+		t.Fatalf("no follow: %+v", r)
+	}
+	if s.count("/ok").Load() != 0 {
+		t.Fatal("redirect followed")
+	}
+}
+
+func TestRate(t *testing.T) {
+	s := newTestServer(t)
+	urls := slices.Repeat([]string{s.url("/ok")}, 5)
+
+	start := time.Now()
+	MultiURLTime(urls, WithRate(50))
+	// a request every 20ms
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("took %v, want at least 80ms", d)
+	}
+
+	for _, rate := range []float64{0, -1, 2e9} {
+		if tick, stop := pacer(rate); tick != nil {
+			stop()
+			t.Fatalf("rate %v: got a ticker", rate)
+		}
+	}
+	MultiURLTime(urls, WithRate(2e9)) // mustn't panic
+}
+
+// recordHandler is a slog.Handler keeping the records it handles.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// messages returns the messages logged so far and forgets them.
+func (h *recordHandler) messages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var msgs []string
+	for _, r := range h.records {
+		msgs = append(msgs, r.Message)
+	}
+	h.records = nil
+	return msgs
+}
+
+func TestLogger(t *testing.T) {
+	s := newTestServer(t)
+	h := &recordHandler{}
+	logger := WithLogger(slog.New(h))
+
+	tests := []struct {
+		url  string
+		opts []Option
+		want []string
+	}{
+		{s.url("/ok"), nil, []string{"request", "done"}},
+		{s.url("/missing"), nil, []string{"request", "bad status"}},
+		{refusedURL(t), nil, []string{"request", "request failed"}},
+		{s.url("/ok"), []Option{WithSlowCallback(time.Nanosecond, func(Result) {})}, []string{"request", "done", "slow"}},
+	}
+	for _, tc := range tests {
+		URLTime(tc.url, append(tc.opts, logger)...)
+		if got := h.messages(); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: logged %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestDownloadAll(t *testing.T) {
+	s := newTestServer(t)
+	destDir := filepath.Join(t.TempDir(), "out")
+	urls := []string{s.url("/file.txt"), s.url("/ok"), s.url("/missing"), s.url("/other/file.txt")}
+
+	results := DownloadAll(context.Background(), urls, destDir, 2)
+	if r := results[0]; r.Err != nil || r.Path != filepath.Join(destDir, "file.txt") || r.Bytes != int64(len(body)) {
+		t.Fatalf("file.txt: %+v", r)
+	}
+	if r := results[2]; r.Kind != KindStatus {
+		t.Fatalf("missing: %+v", r)
+	}
+	if r := results[3]; r.Err == nil || !strings.Contains(r.Err.Error(), "same file name") {
+		t.Fatalf("duplicate name: %+v", r)
+	}
+
+	data, err := os.ReadFile(filepath.Join(destDir, "file.txt"))
+	if err != nil || string(data) != body {
+		t.Fatalf("file.txt = %q, %v", data, err)
+	}
+	entries, _ := os.ReadDir(destDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Fatalf("temporary file %s left", e.Name())
+		}
+	}
+}
+
+func TestDownloadValidators(t *testing.T) {
+	s := newTestServer(t)
+	v := NewValidators()
+	urls := []string{s.url("/etag")}
+	dir := t.TempDir()
+
+	if r := DownloadAll(context.Background(), urls, dir, 1, WithValidators(v))[0]; r.Err != nil || r.Unchanged {
+		t.Fatalf("first download: %+v", r)
+	}
+	if r := DownloadAll(context.Background(), urls, dir, 1, WithValidators(v))[0]; r.Err != nil || !r.Unchanged {
+		t.Fatalf("second download: %+v", r)
+	}
+}
+
+func TestURLTime(t *testing.T) {
+	s := newTestServer(t)
+
+	r := URLTime(s.url("/ok"))
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if r.Status != http.StatusOK || r.Bytes != int64(len(body)) || r.ContentType != "text/plain" {
+		t.Fatalf("result = %+v", r)
+	}
+	if r.Duration <= 0 || r.Kind != KindNone {
+		t.Fatalf("duration = %v, kind = %v", r.Duration, r.Kind)
+	}
+}
+
+func TestURLTimeCtx(t *testing.T) {
+	s := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), slowTime/4)
+	defer cancel()
+	start := time.Now()
+	r := URLTimeCtx(ctx, s.url("/slow"))
+	if !errors.Is(r.Err, context.DeadlineExceeded) || r.Kind != KindTimeout {
+		t.Fatalf("err = %v, kind = %v, want a timeout", r.Err, r.Kind)
+	}
+	if d := time.Since(start); d > slowTime/2 {
+		t.Fatalf("took %v, deadline ignored", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	for _, r := range MultiURLTimeCtx(ctx, []string{s.url("/ok"), s.url("/slow")}) {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Fatalf("%s: err = %v, want %v", r.URL, r.Err, context.Canceled)
+		}
+	}
+}
+
+func TestDownloadFileTimeout(t *testing.T) {
+	s := newTestServer(t)
+
+	results := DownloadAll(context.Background(), []string{s.url("/slow"), s.url("/file.txt")}, t.TempDir(), 1, WithFileTimeout(slowTime/4))
+	if results[0].Kind != KindTimeout {
+		t.Fatalf("slow kind = %v, want timeout", results[0].Kind)
+	}
+	if results[1].Err != nil {
+		t.Fatalf("next file: %v", results[1].Err)
+	}
+}
+
+func TestMultiURLTimeN(t *testing.T) {
+	s := newTestServer(t)
+	urls := slices.Repeat([]string{s.url("/slow")}, 6)
+
+	MultiURLTimeN(urls, 2)
+	if p := s.peak.Load(); p != 2 {
+		t.Fatalf("peak concurrency = %d, want 2", p)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestURLTimeClient(t *testing.T) {
+	// .invalid hosts never resolve, only the canned responses can succeed
+	var calls atomic.Int64
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader(body + req.URL.Host)),
+			Request:    req,
+		}, nil
+	})}
+
+	r := URLTimeClient(client, "http://canned.invalid/")
+	if r.Err != nil || r.Status != http.StatusOK || r.ContentType != "text/plain" {
+		t.Fatalf("result = %+v", r)
+	}
+	if r.Bytes != int64(len(body+"canned.invalid")) {
+		t.Fatalf("bytes = %d, not the canned body", r.Bytes)
+	}
+
+	urls := []string{"http://a.invalid/", "http://bb.invalid/"}
+	for i, r := range MultiURLTimeClient(client, urls) {
+		if r.Err != nil || r.URL != urls[i] || r.Bytes != int64(len(body+"a.invalid")+i) {
+			t.Fatalf("result %d = %+v", i, r)
+		}
+	}
+
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("%d round trips, want 3", n)
+	}
+}
+
+func TestURLTimeRetry(t *testing.T) {
+	s := newTestServer(t)
+
+	r := URLTimeRetry(s.url("/flaky"), 5, time.Millisecond)
+	if r.Err != nil || r.Attempts != 3 {
+		t.Fatalf("flaky: attempts = %d, err = %v", r.Attempts, r.Err)
+	}
+
+	r = URLTimeRetry(s.url("/missing"), 5, time.Millisecond)
+	if r.Err == nil || r.Attempts != 1 {
+		t.Fatalf("4xx retried: attempts = %d", r.Attempts)
+	}
+}
+
+func TestDownloadChecksums(t *testing.T) {
+	s := newTestServer(t)
+	good := sha1.Sum([]byte(body))
+	urls := []string{s.url("/file.txt")}
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	sums := map[string]string{"file.txt": hex.EncodeToString(good[:])}
+	if r := DownloadAll(ctx, urls, dir, 1, WithChecksums(sums, true))[0]; r.Err != nil {
+		t.Fatalf("good checksum: %v", r.Err)
+	}
+
+	bad := map[string]string{"file.txt": "0000"}
+	dir = t.TempDir()
+	r := DownloadAll(ctx, urls, dir, 1, WithChecksums(bad, true))[0]
+	if r.Kind != KindChecksum {
+		t.Fatalf("kind = %v, want checksum", r.Kind)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("bad download kept: %v", entries)
+	}
+
+	r = DownloadAll(ctx, urls, dir, 1, WithChecksums(bad, false))[0]
+	if r.Kind != KindChecksum || r.Path == "" {
+		t.Fatalf("result = %+v", r)
+	}
+	if _, err := os.Stat(r.Path); err != nil {
+		t.Fatal("bad download removed without remove")
+	}
+}
+
+func TestURLTrace(t *testing.T) {
+	s := newTestServer(t)
+
+	tr := URLTrace(s.url("/ok"))
+	if tr.Err != nil || tr.Status != http.StatusOK {
+		t.Fatalf("trace = %+v", tr)
+	}
+	if tr.Connect <= 0 || tr.TTFB <= 0 || tr.Total < tr.TTFB || tr.TLSInfo != nil {
+		t.Fatalf("trace = %+v", tr)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var durations []time.Duration
+	for i := 1; i <= 100; i++ {
+		durations = append(durations, time.Duration(i))
+	}
+
+	for _, tc := range []struct {
+		p    int
+		want time.Duration
+	}{{50, 50}, {90, 90}, {99, 99}, {100, 100}, {0, 1}} {
+		if got := percentile(durations, tc.p); got != tc.want {
+			t.Errorf("p%d = %v, want %v", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestURLStats(t *testing.T) {
+	s := newTestServer(t)
+
+	stats := URLStats(s.url("/ok"), 10)
+	if stats.Errors != 0 || stats.Min <= 0 || stats.Min > stats.P50 || stats.P50 > stats.Max {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if n := s.count("/ok").Load(); n != 10 {
+		t.Fatalf("%d requests, want 10", n)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := newTestServer(t)
+
+	r := URLTime(s.url("/gzip"), WithCompression())
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	size := int64(len(body) * 100)
+	if r.Bytes != size || r.DecompressedBytes != size {
+		t.Fatalf("bytes = %d, decompressed = %d, want %d", r.Bytes, r.DecompressedBytes, size)
+	}
+	if r.CompressedBytes == 0 || r.CompressedBytes >= size {
+		t.Fatalf("compressed = %d", r.CompressedBytes)
+	}
+}
+
+func TestURLTimeReq(t *testing.T) {
+	s := newTestServer(t)
+
+	var method string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			method = resp.Header.Get("X-Method")
+		}
+		return resp, err
+	})}
+
+	req, err := http.NewRequest(http.MethodPost, s.url("/echo"), strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := URLTimeReq(req, WithClient(client), WithSHA256())
+	if r.Err != nil || r.Bytes != int64(len("payload")) {
+		t.Fatalf("result = %+v", r)
+	}
+	if method != http.MethodPost {
+		t.Fatalf("server got a %s, want a POST", method)
+	}
+	if r.SHA256 != sha256Hex("payload") {
+		t.Fatal("body not echoed")
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	s := newTestServer(t)
+	h := &recordHandler{}
+
+	header := http.Header{"Authorization": {"secret"}, "X-Test": {"value"}}
+	r := URLTime(s.url("/header"), WithHeaders(header), WithSHA256(), WithLogger(slog.New(h)))
+	if r.SHA256 != sha256Hex("value") {
+		t.Fatal("header not sent")
+	}
+
+	// the logged request header hides the Authorization
+	var logged http.Header
+	for _, rec := range h.records {
+		rec.Attrs(func(a slog.Attr) bool {
+			if a.Key == "header" {
+				logged, _ = a.Value.Any().(http.Header)
+			}
+			return true
+		})
+	}
+	if logged.Get("Authorization") != "REDACTED" || logged.Get("X-Test") != "value" {
+		t.Fatalf("logged header = %v", logged)
+	}
+	if header.Get("Authorization") != "secret" {
+		t.Fatal("caller header modified")
+	}
+}
+
+func TestWithHeader(t *testing.T) {
+	s := newTestServer(t)
+
+	if r := URLTime(s.url("/header"), WithHeader("x-test", "value"), WithSHA256()); r.SHA256 != sha256Hex("value") {
+		t.Fatal("header not sent")
+	}
+}
+
+func TestMultiURLTime(t *testing.T) {
+	s := newTestServer(t)
+	urls := []string{s.url("/ok"), s.url("/missing"), s.url("/slow")}
+
+	start := time.Now()
+	results := MultiURLTime(urls)
+	if d := time.Since(start); d > 2*slowTime {
+		t.Fatalf("took %v, not concurrent", d)
+	}
+	for i, r := range results {
+		if r.URL != urls[i] {
+			t.Fatalf("result %d is for %s, want %s", i, r.URL, urls[i])
+		}
+	}
+	if results[1].Kind != KindStatus || results[2].Err != nil {
+		t.Fatalf("results = %+v", results)
+	}
+}
+
+func TestMultiURLTimeBudget(t *testing.T) {
+	s := newTestServer(t)
+
+	results := MultiURLTimeBudget([]string{s.url("/ok"), s.url("/slow")}, slowTime/4)
+	if results[0].Err != nil {
+		t.Fatalf("fast URL: %v", results[0].Err)
+	}
+	if results[1].Kind != KindTimeout {
+		t.Fatalf("slow URL kind = %v, want timeout", results[1].Kind)
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	s := newTestServer(t)
+
+	if err := WaitHealthy(context.Background(), s.url("/flaky"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count("/flaky").Load(); n != 3 {
+		t.Fatalf("%d probes, want 3", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := WaitHealthy(ctx, s.url("/missing"), time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := WaitHealthy(context.Background(), s.url("/ok"), interval); err == nil {
+			t.Fatalf("interval %v: no error", interval)
+		}
+	}
+	if n := s.count("/ok").Load(); n != 0 {
+		t.Fatalf("%d probes with an invalid interval, want 0", n)
+	}
+}
+
+func TestMultiURLTimeStream(t *testing.T) {
+	s := newTestServer(t)
+	urls := []string{s.url("/slow"), s.url("/ok")}
+
+	var got []string
+	for r := range MultiURLTimeStream(context.Background(), urls, 2) {
+		got = append(got, r.URL)
+	}
+	// completion order
+	if want := []string{s.url("/ok"), s.url("/slow")}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRateShared(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	// a request every 20ms, whichever function makes them
+	start := time.Now()
+	for range MultiURLTimeStream(ctx, slices.Repeat([]string{s.url("/ok")}, 3), 3, WithRate(50)) {
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("stream took %v, want at least 40ms", d)
+	}
+
+	start = time.Now()
+	urls := []string{s.url("/ok"), s.url("/file.txt"), s.url("/etag")}
+	for _, r := range DownloadAll(ctx, urls, t.TempDir(), 3, WithRate(50)) {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("downloads took %v, want at least 40ms", d)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	s := newTestServer(t)
+	url := s.url("/slow")
+
+	results := MultiURLTime([]string{url, url, url}, WithDedupe())
+	if n := s.count("/slow").Load(); n != 1 {
+		t.Fatalf("%d requests, want 1", n)
+	}
+	if results[2].Status != http.StatusOK {
+		t.Fatalf("duplicate result = %+v", results[2])
+	}
+
+	// concurrent calls share the request only with the same options
+	s.count("/slow").Store(0)
+	var wg sync.WaitGroup
+	for _, opts := range [][]Option{{WithDedupe()}, {WithDedupe()}, {WithDedupe(), WithSHA256()}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			URLTime(url, opts...)
+		}()
+	}
+	wg.Wait()
+	if n := s.count("/slow").Load(); n != 2 {
+		t.Fatalf("%d requests, want 2", n)
+	}
+}
+
+func TestDedupeFailureNotShared(t *testing.T) {
+	s := newTestServer(t)
+	url := s.url("/slow")
+
+	ctx, cancel := context.WithTimeout(context.Background(), slowTime/4)
+	defer cancel()
+	leader := make(chan Result)
+	go func() { leader <- URLTimeCtx(ctx, url, WithDedupe()) }()
+
+	time.Sleep(slowTime / 8) // join the leader request
+	r := URLTime(url, WithDedupe())
+	if r.Err != nil {
+		t.Fatalf("waiter got the leader failure: %v", r.Err)
+	}
+	if lr := <-leader; lr.Kind != KindTimeout {
+		t.Fatalf("leader kind = %v, want timeout", lr.Kind)
+	}
+}
+
+func TestReports(t *testing.T) {
+	results := []Result{
+		{URL: "http://a.com", Status: 200, Duration: 1500 * time.Microsecond, Bytes: 10},
+		{URL: "http://b.com", Err: fmt.Errorf("boom")},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteResultsCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"url", "status", "duration_ms", "bytes", "error"},
+		{"http://a.com", "200", "1.500", "10", ""},
+		{"http://b.com", "0", "0.000", "0", "boom"},
+	}
+	if !slices.EqualFunc(records, want, slices.Equal) {
+		t.Fatalf("CSV = %v", records)
+	}
+
+	buf.Reset()
+	if err := WriteResultsJSON(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var out []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out[0]["error"] != nil || out[1]["error"] != "boom" || out[0]["duration_ms"] != 1.5 {
+		t.Fatalf("JSON = %v", out)
+	}
+}
+
+func TestSlowCallback(t *testing.T) {
+	s := newTestServer(t)
+
+	slow := make(chan Result, 1)
+	URLTime(s.url("/slow"), WithSlowCallback(slowTime/2, func(r Result) { slow <- r }))
+	select {
+	case r := <-slow:
+		if r.URL != s.url("/slow") {
+			t.Fatalf("callback got %s", r.URL)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback not called")
+	}
+
+	URLTime(s.url("/ok"), WithSlowCallback(time.Hour, func(Result) { t.Error("fast request reported") }))
+}
+
+func TestFinalURL(t *testing.T) {
+	s := newTestServer(t)
+
+	r := URLTime(s.url("/redirect"))
+	if r.Redirects != 1 || r.FinalURL != s.url("/ok") {
+		t.Fatalf("follow: redirects = %d, final URL = %s", r.Redirects, r.FinalURL)
+	}
+
+	r = URLTime(s.url("/redirect"), WithFollowRedirects(false))
+	if r.Redirects != 0 || r.FinalURL != s.url("/redirect") {
+		t.Fatalf("no follow: redirects = %d, final URL = %s", r.Redirects, r.FinalURL)
+	}
+
+	if r := URLTime(s.url("/ok")); r.Redirects != 0 || r.FinalURL != s.url("/ok") {
+		t.Fatalf("no redirect: redirects = %d, final URL = %s", r.Redirects, r.FinalURL)
+	}
+}
+
+func TestReadURLs(t *testing.T) {
+	in := "# comment\nhttp://a.com\n\n  https://b.com/x  \n"
+	urls, err := ReadURLs(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://a.com", "https://b.com/x"}; !slices.Equal(urls, want) {
+		t.Fatalf("urls = %v, want %v", urls, want)
+	}
+
+	_, err = ReadURLs(strings.NewReader("http://a.com\nnot-a-url\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "2:") {
+		t.Fatalf("err = %v, want a line 2 error", err)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := newTestServer(t)
+
+	r := URLTime(s.url("/ok"), WithMaxBodyBytes(5))
+	if r.Err != nil || r.Bytes != 5 || !r.Truncated {
+		t.Fatalf("result = %+v", r)
+	}
+	r = URLTime(s.url("/ok"), WithMaxBodyBytes(int64(len(body))))
+	if r.Truncated {
+		t.Fatal("exact size reported as truncated")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok := <-Monitor(ctx, s.url("/ok"), 0); ok {
+		t.Fatal("got a result with a zero interval")
+	}
+	if n := s.count("/ok").Load(); n != 0 {
+		t.Fatalf("%d requests with a zero interval, want 0", n)
+	}
+
+	ch := Monitor(ctx, s.url("/ok"), time.Millisecond)
+	for range 3 {
+		if r := <-ch; r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	cancel()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel not closed after cancel")
+		}
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix sockets:", err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	s.Listener = ln
+	s.Start()
+	defer s.Close()
+
+	transport := UnixTransport(path)
+	defer transport.CloseIdleConnections()
+	r := URLTime("http://unix/health", WithTransport(transport))
+	if r.Err != nil || r.Bytes != int64(len(body)) {
+		t.Fatalf("result = %+v", r)
+	}
+}
+
+func TestGroupByHost(t *testing.T) {
+	results := []Result{
+		{URL: "http://a.com/1", Duration: 10},
+		{URL: "http://a.com/2", Duration: 30},
+		{URL: "http://a.com/3", Err: fmt.Errorf("boom")},
+		{URL: "http://b.com:8080/", Duration: 5},
+		{URL: "not a url"},
+	}
+
+	stats := GroupByHost(results)
+	if a := stats["a.com"]; a.Count != 3 || a.Errors != 1 || a.Mean != 20 || a.Max != 30 {
+		t.Fatalf("a.com = %+v", a)
+	}
+	if b := stats["b.com:8080"]; b.Count != 1 {
+		t.Fatalf("b.com:8080 = %+v", b)
+	}
+	if stats[InvalidHost].Count != 1 {
+		t.Fatalf("stats = %v", stats)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer s.Close()
+
+	// first, so the handshake isn't skipped by a reused connection
+	tr := URLTrace(s.URL, WithClient(s.Client()))
+	if tr.Err != nil || tr.TLS <= 0 || tr.TLSInfo == nil {
+		t.Fatalf("trace = %+v", tr)
+	}
+
+	r := URLTime(s.URL, WithClient(s.Client()))
+	if r.Err != nil || r.TLS == nil || r.TLS.Version == "" {
+		t.Fatalf("result = %+v, TLS = %+v", r, r.TLS)
+	}
+	cert := s.Certificate()
+	if !r.TLS.NotAfter.After(time.Now()) || !r.TLS.NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("NotAfter = %v, want %v", r.TLS.NotAfter, cert.NotAfter)
+	}
+	if r.TLS.Subject != cert.Subject.String() || r.TLS.Issuer != cert.Issuer.String() {
+		t.Fatalf("subject = %q, issuer = %q", r.TLS.Subject, r.TLS.Issuer)
+	}
+}
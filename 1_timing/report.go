@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// durationMS returns d in milliseconds.
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// WriteResultsCSV writes results to w as CSV with a header line. The columns are url,
+// status, duration_ms, bytes and error, which is empty for successful results.
+func WriteResultsCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"url", "status", "duration_ms", "bytes", "error"}); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		var errMsg string
+		if r.Err != nil {
+			errMsg = r.Err.Error()
+		}
+		record := []string{
+			r.URL,
+			strconv.Itoa(r.Status),
+			strconv.FormatFloat(durationMS(r.Duration), 'f', 3, 64),
+			strconv.FormatInt(r.Bytes, 10),
+			errMsg,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// jsonResult is the JSON form of a Result.
+type jsonResult struct {
+	URL        string  `json:"url"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Bytes      int64   `json:"bytes"`
+	Error      *string `json:"error"` // null for successful results
+}
+
+// WriteResultsJSON writes results to w as a JSON array of objects with url, status,
+// duration_ms, bytes and error, which is null for successful results.
+func WriteResultsJSON(w io.Writer, results []Result) error {
+	out := make([]jsonResult, len(results))
+	for i, r := range results {
+		out[i] = jsonResult{
+			URL:        r.URL,
+			Status:     r.Status,
+			DurationMS: durationMS(r.Duration),
+			Bytes:      r.Bytes,
+		}
+		if r.Err != nil {
+			msg := r.Err.Error()
+			out[i].Error = &msg
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
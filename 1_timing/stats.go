@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Stats summarizes the durations of repeated requests, failed requests are only counted
+// in Errors.
+type Stats struct {
+	Min, Max, Mean time.Duration
+	P50, P90, P99  time.Duration
+	Errors         int
+}
+
+// URLStats gets url samples times, one after the other over a keep-alive connection
+// (see Benchmark), and returns the latency statistics.
+func URLStats(url string, samples int, opts ...Option) Stats {
+	var s Stats
+	var durations []time.Duration
+	for _, r := range Benchmark(url, samples, 0, opts...) {
+		if r.Err != nil {
+			s.Errors++
+			continue
+		}
+		durations = append(durations, r.Duration)
+	}
+	if len(durations) == 0 {
+		return s
+	}
+
+	slices.Sort(durations)
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	s.Min, s.Max = durations[0], durations[len(durations)-1]
+	s.Mean = total / time.Duration(len(durations))
+	s.P50 = percentile(durations, 50)
+	s.P90 = percentile(durations, 90)
+	s.P99 = percentile(durations, 99)
+	return s
+}
+
+// percentile returns the p percentile of sorted, using the nearest rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
+
+// HostStats summarizes the results for a host. Mean and Max are over successful results.
+type HostStats struct {
+	Count     int
+	Mean, Max time.Duration
+	Errors    int
+}
+
+// InvalidHost is the GroupByHost key of results whose URL has no host.
+const InvalidHost = "invalid"
+
+// GroupByHost returns the stats of results by the host (with port, if any) of their URL.
+func GroupByHost(results []Result) map[string]HostStats {
+	stats := make(map[string]HostStats)
+	totals := make(map[string]time.Duration)
+	for _, r := range results {
+		host := InvalidHost
+		if u, err := url.Parse(r.URL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+
+		hs := stats[host]
+		hs.Count++
+		if r.Err != nil {
+			hs.Errors++
+		} else {
+			totals[host] += r.Duration
+			hs.Max = max(hs.Max, r.Duration)
+		}
+		stats[host] = hs
+	}
+
+	for host, hs := range stats {
+		if ok := hs.Count - hs.Errors; ok > 0 {
+			hs.Mean = totals[host] / time.Duration(ok)
+			stats[host] = hs
+		}
+	}
+	return stats
+}
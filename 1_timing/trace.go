@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Trace is the timing breakdown of a request. Phases that didn't happen, e.g. TLS for
+// plain HTTP or DNS and Connect for a reused connection, are 0.
+type Trace struct {
+	URL     string
+	DNS     time.Duration // host name lookup
+	Connect time.Duration // TCP connect
+	TLS     time.Duration // TLS handshake
+	TTFB    time.Duration // from start to the first response byte
+	Total   time.Duration // from start to the end of the body
+	Status  int
+	Err     error
+	TLSInfo *TLSInfo // nil for plain HTTP
+}
+
+// TLSInfo describes the TLS connection and the server certificate of an HTTPS response.
+type TLSInfo struct {
+	Subject  string
+	Issuer   string
+	NotAfter time.Time // certificate expiration
+	Version  string    // e.g. "TLS 1.3"
+}
+
+// tlsInfo returns the TLSInfo of cs, nil if cs is nil (plain HTTP).
+func tlsInfo(cs *tls.ConnectionState) *TLSInfo {
+	if cs == nil {
+		return nil
+	}
+
+	info := &TLSInfo{Version: tls.VersionName(cs.Version)}
+	if len(cs.PeerCertificates) > 0 {
+		cert := cs.PeerCertificates[0] // the server's, the others are its chain
+		info.Subject = cert.Subject.String()
+		info.Issuer = cert.Issuer.String()
+		info.NotAfter = cert.NotAfter
+	}
+	return info
+}
+
+// URLTrace gets url and returns where the time went.
+func URLTrace(url string, opts ...Option) Trace {
+	o := newOptions(opts)
+	t := Trace{URL: url}
+
+	// The hooks can run on the transport's dial goroutines, even after Do returns
+	// (e.g. a losing dial to another address), so they only touch p under mu.
+	var (
+		mu                               sync.Mutex
+		p                                Trace
+		dnsStart, connectStart, tlsStart time.Time
+	)
+	locked := func(fn func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn()
+	}
+	start := time.Now()
+	ct := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { locked(func() { p.DNS = time.Since(dnsStart) }) },
+		ConnectStart: func(string, string) {
+			locked(func() {
+				if connectStart.IsZero() { // with several addresses, time the whole connect
+					connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(string, string, error) {
+			locked(func() { p.Connect = time.Since(connectStart) })
+		},
+		TLSHandshakeStart: func() { locked(func() { tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { p.TLS = time.Since(tlsStart) })
+		},
+		GotFirstResponseByte: func() { locked(func() { p.TTFB = time.Since(start) }) },
+	}
+	phases := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		t.DNS, t.Connect, t.TLS, t.TTFB = p.DNS, p.Connect, p.TLS, p.TTFB
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+	o.setHeaders(req)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		t.Err = err
+		t.Total = time.Since(start)
+		phases()
+		return t
+	}
+	defer resp.Body.Close()
+
+	t.Status = resp.StatusCode
+	t.TLSInfo = tlsInfo(resp.TLS)
+	_, t.Err = io.Copy(io.Discard, resp.Body)
+	t.Total = time.Since(start)
+	phases()
+	return t
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// WithTransport makes requests go through rt, e.g. to configure connection pooling or
+// to reach servers on Unix sockets (see UnixTransport). It replaces WithClient.
+func WithTransport(rt http.RoundTripper) Option {
+	return WithClient(&http.Client{Transport: rt})
+}
+
+// UnixTransport returns a transport sending every request to the server listening on the
+// Unix socket at socketPath, whatever the host in the URL, e.g.
+//
+//	URLTime("http://unix/health", WithTransport(UnixTransport("/run/app.sock")))
+func UnixTransport(socketPath string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	return transport
+}
@@ -1,24 +1,152 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
 	"time"
 )
 
+// hashers is a pool of SHA1 hashers, saving an allocation per signature.
+var hashers = sync.Pool{
+	New: func() any {
+		return sha1.New()
+	},
+}
+
 // sha1sig return SHA1 signature in the format "35aabcd5a32e01d18a5ef688111624f3c547e13b"
 func sha1Sig(data []byte) (string, error) {
-	w := sha1.New()
-	r := bytes.NewReader(data)
+	w := hashers.Get().(hash.Hash)
+	defer hashers.Put(w)
+	w.Reset()
+
+	w.Write(data) // hash.Hash Write never fails
+	var sum [sha1.Size]byte
+	return hex.EncodeToString(w.Sum(sum[:0])), nil
+}
+
+// sha1SigReader is sha1Sig for content read from r, it doesn't load it all to memory.
+func sha1SigReader(r io.Reader) (string, error) {
+	w := hashers.Get().(hash.Hash)
+	defer hashers.Put(w)
+	w.Reset()
+
 	if _, err := io.Copy(w, r); err != nil {
 		return "", err
 	}
 
-	sig := fmt.Sprintf("%x", w.Sum(nil))
-	return sig, nil
+	var sum [sha1.Size]byte
+	return hex.EncodeToString(w.Sum(sum[:0])), nil
+}
+
+// fileSig returns the signature of the file at path, see FileTreeSig.
+func fileSig(path string) (string, error) {
+	return FileTreeSig(path, runtime.GOMAXPROCS(0))
+}
+
+const (
+	// chunkSize is the size of chunks hashed by TreeSig, it's part of the scheme and
+	// changing it changes the signatures.
+	chunkSize = 1 << 20
+	// treeThreshold is the size from which TreeSig hashes in chunks.
+	treeThreshold = 4 * chunkSize
+)
+
+// TreeSig returns a signature of data computed with up to workers goroutines.
+// Data smaller than treeThreshold is hashed as sha1Sig does. Larger data is split into
+// chunkSize chunks that are hashed concurrently, the signature is the SHA1 of the
+// concatenated chunk SHA1s (in chunk order). The result doesn't depend on workers.
+func TreeSig(data []byte, workers int) (string, error) {
+	if len(data) < treeThreshold {
+		return sha1Sig(data)
+	}
+	n := (len(data) + chunkSize - 1) / chunkSize
+	return treeSig(n, workers, func(c int) ([sha1.Size]byte, error) {
+		end := min((c+1)*chunkSize, len(data))
+		return sha1.Sum(data[c*chunkSize : end]), nil
+	})
+}
+
+// FileTreeSig is TreeSig for the file at path, which isn't loaded to memory: every chunk
+// is read by the goroutine hashing it. It returns the same signature as TreeSig would for
+// the file content.
+func FileTreeSig(path string, workers int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size < treeThreshold {
+		return sha1SigReader(file)
+	}
+
+	n := int((size + chunkSize - 1) / chunkSize)
+	return treeSig(n, workers, func(c int) ([sha1.Size]byte, error) {
+		var sum [sha1.Size]byte
+		w := hashers.Get().(hash.Hash)
+		defer hashers.Put(w)
+		w.Reset()
+
+		off := int64(c) * chunkSize
+		chunk := io.NewSectionReader(file, off, min(chunkSize, size-off))
+		if _, err := io.Copy(w, chunk); err != nil {
+			return sum, err
+		}
+		w.Sum(sum[:0])
+		return sum, nil
+	})
+}
+
+// treeSig hashes n chunks with hashChunk using up to workers goroutines and returns the
+// SHA1 of the concatenated chunk SHA1s.
+func treeSig(n, workers int, hashChunk func(c int) ([sha1.Size]byte, error)) (string, error) {
+	workers = clampWorkers(workers)
+	sums := make([][sha1.Size]byte, n)
+	errs := make([]error, n)
+	chunks := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				sums[c], errs[c] = hashChunk(c)
+			}
+		}()
+	}
+
+	for c := 0; c < n; c++ {
+		chunks <- c
+	}
+	close(chunks)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+
+	w := sha1.New()
+	for _, sum := range sums {
+		w.Write(sum[:])
+	}
+	return fmt.Sprintf("%x", w.Sum(nil)), nil
 }
 
 type File struct {
@@ -33,22 +161,50 @@ type Reply struct {
 	err      error
 }
 
+// sign computes the signatures checked by signWorker, tests replace it to observe the workers.
+var sign = sha1Sig
+
 func signWorker(file File, ch chan<- Reply) {
-	sig, err := sha1Sig(file.Content)
+	sig, err := sign(file.Content)
 	r := Reply{filename: file.Name, match: sig == file.Signature, err: err}
 	ch <- r
 }
 
 // ValidateSigs return slice of OK files and slice of mismatched files
 func ValidateSigs(files []File) ([]string, []string, error) {
+	return ValidateSigsN(files, len(files))
+}
+
+// clampWorkers limits workers to [1, 4*GOMAXPROCS], hashing is CPU bound and more
+// goroutines than that won't make it faster.
+func clampWorkers(workers int) int {
+	return min(max(workers, 1), 4*runtime.GOMAXPROCS(0))
+}
+
+// ValidateSigsN is ValidateSigs using a pool of workers goroutines.
+// workers is clamped to [1, 4*GOMAXPROCS].
+func ValidateSigsN(files []File, workers int) ([]string, []string, error) {
 	var okFiles []string
 	var badFiles []string
-	ch := make(chan Reply)
+	// buffered so workers can always send and exit, even if we stop reading early
+	ch := make(chan Reply, len(files))
 
-	for _, file := range files {
-		go signWorker(file, ch)
+	jobs := make(chan File)
+	for i := 0; i < clampWorkers(workers); i++ {
+		go func() {
+			for file := range jobs {
+				signWorker(file, ch)
+			}
+		}()
 	}
 
+	go func() {
+		for _, file := range files {
+			jobs <- file
+		}
+		close(jobs)
+	}()
+
 	for range files {
 		r := <-ch
 		if !r.match || r.err != nil {
@@ -60,6 +216,115 @@ func ValidateSigs(files []File) ([]string, []string, error) {
 	return okFiles, badFiles, nil
 }
 
+type sigReply struct {
+	path string
+	sig  string
+	err  error
+}
+
+// dirSigs returns the signature of every file under root, keyed by path relative to root.
+// Files are hashed by workers goroutines.
+func dirSigs(root string, workers int) (map[string]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make(chan string)
+	ch := make(chan sigReply)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				sig, err := fileSig(filepath.Join(root, rel))
+				ch <- sigReply{path: rel, sig: sig, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, rel := range paths {
+			jobs <- rel
+		}
+		close(jobs)
+		wg.Wait()
+		close(ch)
+	}()
+
+	sigs := make(map[string]string, len(paths))
+	var errs []error
+	for r := range ch {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		sigs[r.path] = r.sig
+	}
+	return sigs, errors.Join(errs...)
+}
+
+// CompareDirs compares the files in dstDir (e.g. a backup) to the ones in srcDir.
+// added are files only in dstDir, removed are files only in srcDir and changed are
+// files in both with different content. Paths are relative and sorted.
+// Both directories are hashed concurrently, each with up to workers goroutines.
+// workers is clamped to [1, 4*GOMAXPROCS].
+func CompareDirs(srcDir, dstDir string, workers int) (added, removed, changed []string, err error) {
+	workers = clampWorkers(workers)
+
+	var srcSigs, dstSigs map[string]string
+	var srcErr, dstErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		srcSigs, srcErr = dirSigs(srcDir, workers)
+	}()
+	go func() {
+		defer wg.Done()
+		dstSigs, dstErr = dirSigs(dstDir, workers)
+	}()
+	wg.Wait()
+
+	if err := errors.Join(srcErr, dstErr); err != nil {
+		return nil, nil, nil, err
+	}
+
+	for path, sig := range srcSigs {
+		dstSig, ok := dstSigs[path]
+		switch {
+		case !ok:
+			removed = append(removed, path)
+		case sig != dstSig:
+			changed = append(changed, path)
+		}
+	}
+	for path := range dstSigs {
+		if _, ok := srcSigs[path]; !ok {
+			added = append(added, path)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(changed)
+	return added, removed, changed, nil
+}
+
 func main() {
 	start := time.Now()
 
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sig(data []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// bigData returns data large enough for TreeSig to hash in chunks, the last one partial.
+func bigData() []byte {
+	data := make([]byte, treeThreshold+chunkSize/2)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestTreeSig(t *testing.T) {
+	small := []byte("small")
+	if got, _ := TreeSig(small, 4); got != sig(small) {
+		t.Fatalf("small: got %s, want the plain SHA1", got)
+	}
+
+	data := bigData()
+	want, err := TreeSig(data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want == sig(data) {
+		t.Fatal("large data not hashed in chunks")
+	}
+	for _, workers := range []int{0, 3, 64} {
+		if got, _ := TreeSig(data, workers); got != want {
+			t.Fatalf("workers %d: got %s, want %s", workers, got, want)
+		}
+	}
+}
+
+func TestFileTreeSig(t *testing.T) {
+	dir := t.TempDir()
+	for _, data := range [][]byte{[]byte("small"), bigData()} {
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := TreeSig(data, 4)
+		got, err := FileTreeSig(path, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%d bytes: got %s, want %s", len(data), got, want)
+		}
+	}
+
+	if _, err := FileTreeSig(filepath.Join(dir, "missing"), 1); err == nil {
+		t.Fatal("no error for a missing file")
+	}
+}
+
+func BenchmarkTreeSig(b *testing.B) {
+	data := bigData()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		TreeSig(data, runtime.GOMAXPROCS(0))
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompareDirs(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"same.txt":       "same",
+		"changed.txt":    "old",
+		"removed.txt":    "gone",
+		"sub/nested.txt": "nested",
+	})
+	writeFiles(t, dst, map[string]string{
+		"same.txt":       "same",
+		"changed.txt":    "new",
+		"added.txt":      "new file",
+		"sub/nested.txt": "nested",
+	})
+
+	// a huge count must be clamped, not start a goroutine per worker
+	for _, workers := range []int{-1, 2, 1 << 30} {
+		added, removed, changed, err := CompareDirs(src, dst, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(added, []string{"added.txt"}) ||
+			!slices.Equal(removed, []string{"removed.txt"}) ||
+			!slices.Equal(changed, []string{"changed.txt"}) {
+			t.Fatalf("workers %d: added %v, removed %v, changed %v", workers, added, removed, changed)
+		}
+	}
+
+	if _, _, _, err := CompareDirs(src, filepath.Join(dst, "missing"), 2); err == nil {
+		t.Fatal("no error for a missing directory")
+	}
+}
+
+func TestSha1Sig(t *testing.T) {
+	data := []byte("Hello, World!")
+	got, err := sha1Sig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0a0a9f2a6772942557ab5355d76af442f8f65e01"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	got, err = sha1SigReader(bytes.NewReader(data))
+	if err != nil || got != sig(data) {
+		t.Fatalf("reader: got %s, %v", got, err)
+	}
+}
+
+func BenchmarkSha1Sig(b *testing.B) {
+	data := make([]byte, 64<<10)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		sha1Sig(data)
+	}
+}
+
+// numbered returns n files with distinct content and no valid signature.
+func numbered(n int) []File {
+	files := make([]File, n)
+	for i := range files {
+		files[i] = File{Name: fmt.Sprint(i), Content: []byte(fmt.Sprint(i))}
+	}
+	return files
+}
+
+func TestSignWorkerNoReader(t *testing.T) {
+	files := numbered(100)
+	// buffered as in ValidateSigsN, nobody reads it
+	ch := make(chan Reply, len(files))
+
+	var wg sync.WaitGroup
+	wg.Add(len(files))
+	for _, file := range files {
+		go func() {
+			defer wg.Done()
+			signWorker(file, ch)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("workers blocked sending their replies")
+	}
+	if n := len(ch); n != len(files) {
+		t.Fatalf("%d replies, want %d", n, len(files))
+	}
+}
+
+func TestValidateSigs(t *testing.T) {
+	files := []File{
+		{"a", []byte("a"), sig([]byte("a"))},
+		{"b", []byte("b"), "bad"},
+		{"c", []byte("c"), sig([]byte("c"))},
+	}
+
+	for _, workers := range []int{-1, 1, 2, 100} {
+		ok, bad, err := ValidateSigsN(files, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(ok)
+		if !slices.Equal(ok, []string{"a", "c"}) || !slices.Equal(bad, []string{"b"}) {
+			t.Fatalf("workers %d: ok = %v, bad = %v", workers, ok, bad)
+		}
+	}
+}
+
+func TestValidateSigsClamp(t *testing.T) {
+	var active, peak atomic.Int64
+	sign = func(data []byte) (string, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		return sha1Sig(data)
+	}
+	t.Cleanup(func() { sign = sha1Sig })
+
+	limit := 4 * runtime.GOMAXPROCS(0)
+	files := numbered(4 * limit)
+	_, bad, err := ValidateSigsN(files, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != len(files) {
+		t.Fatalf("%d files checked, want %d", len(bad), len(files))
+	}
+	if p := peak.Load(); p > int64(limit) {
+		t.Fatalf("peak of %d concurrent signatures, want at most %d", p, limit)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "b.txt": "b", "sub/c.txt": "c"}
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+
+	root, err := HashTree(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := HashTree(dir, 8); again != root {
+		t.Fatalf("root depends on workers: %s != %s", again, root)
+	}
+
+	// same files elsewhere, same root
+	other := t.TempDir()
+	writeFiles(t, other, files)
+	if got, _ := HashTree(other, 2); got != root {
+		t.Fatalf("copy: got %s, want %s", got, root)
+	}
+
+	// renaming or changing a file changes the root
+	if err := os.Rename(filepath.Join(other, "a.txt"), filepath.Join(other, "z.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := HashTree(other, 2); got == root {
+		t.Fatal("rename didn't change the root")
+	}
+	writeFiles(t, dir, map[string]string{"b.txt": "B"})
+	if got, _ := HashTree(dir, 2); got == root {
+		t.Fatal("content change didn't change the root")
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaf := func(s string) []byte {
+		h := sha1.Sum([]byte(s))
+		return h[:]
+	}
+	pair := func(a, b []byte) []byte {
+		h := sha1.Sum(append(slices.Clip(a), b...))
+		return h[:]
+	}
+	a, b, c := leaf("a"), leaf("b"), leaf("c")
+
+	tests := []struct {
+		name  string
+		level [][]byte
+		want  []byte
+	}{
+		{"one", [][]byte{a}, a},
+		{"two", [][]byte{a, b}, pair(a, b)},
+		{"odd carried", [][]byte{a, b, c}, pair(pair(a, b), c)},
+	}
+	for _, tc := range tests {
+		if got := merkleRoot(tc.level); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %x, want %x", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"slices"
+)
+
+// HashTree returns the Merkle root of the files under root, hashed by up to workers
+// goroutines. The leaves are the hashes of every file relative path and signature,
+// sorted by path, so changing the content or the name of any file changes the root.
+func HashTree(root string, workers int) (string, error) {
+	sigs, err := dirSigs(root, clampWorkers(workers))
+	if err != nil {
+		return "", err
+	}
+
+	paths := make([]string, 0, len(sigs))
+	for path := range sigs {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	level := make([][]byte, len(paths))
+	for i, path := range paths {
+		// slash separated so the root doesn't depend on the OS
+		leaf := sha1.Sum([]byte(filepath.ToSlash(path) + "\x00" + sigs[path]))
+		level[i] = leaf[:]
+	}
+	return hex.EncodeToString(merkleRoot(level)), nil
+}
+
+// merkleRoot combines hashes pairwise, level by level, until one is left. An odd hash
+// out is carried to the next level as is.
+func merkleRoot(level [][]byte) []byte {
+	if len(level) == 0 {
+		empty := sha1.Sum(nil)
+		return empty[:]
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := sha1.Sum(append(slices.Clip(level[i]), level[i+1]...))
+			next = append(next, node[:])
+		}
+		level = next
+	}
+	return level[0]
+}
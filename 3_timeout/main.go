@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -24,30 +26,432 @@ type Movie struct {
 
 // BestNextMovie return the best move recommendation for a user
 func BestNextMovie(user string) Movie {
-	time.Sleep(bmvTime) // Simulate work
+	m, _ := BestNextMovieCtx(context.Background(), user)
+	return m
+}
+
+// BestNextMovieCtx is BestNextMovie that stops working once ctx is done
+func BestNextMovieCtx(ctx context.Context, user string) (Movie, error) {
+	timer := time.NewTimer(bmvTime) // Simulate work
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return Movie{}, ctx.Err()
+	}
 
 	// Don't change this, otherwise the test will fail
 	return Movie{
 		ID:    "tt0083658",
 		Title: "Blade Runner",
+	}, nil
+}
+
+// Recommender is a movie recommendation backend
+type Recommender interface {
+	Recommend(ctx context.Context, user string) (Movie, error)
+}
+
+// RecommenderFunc adapts a function to a Recommender, so functions can be passed to
+// NextMovie or NextMovieChain.
+type RecommenderFunc func(ctx context.Context, user string) (Movie, error)
+
+func (f RecommenderFunc) Recommend(ctx context.Context, user string) (Movie, error) {
+	return f(ctx, user)
+}
+
+// staticRecommender recommends using BestNextMovieCtx
+type staticRecommender struct{}
+
+func (staticRecommender) Recommend(ctx context.Context, user string) (Movie, error) {
+	return BestNextMovieCtx(ctx, user)
+}
+
+// ErrBreakerOpen is returned by a breaker recommender while it's open.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// breakerRecommender is a circuit breaker around a Recommender.
+type breakerRecommender struct {
+	rec       Recommender
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // zero when closed
+	probing   bool      // a half-open probe is running
+}
+
+// NewBreakerRecommender returns a Recommender that calls rec until it fails threshold
+// times in a row (errors and timeouts). It then fails right away with ErrBreakerOpen for
+// cooldown, so NextMovie falls back without waiting. After cooldown, a single call is let
+// through to probe rec: success closes the breaker and failure opens it again.
+// Calls cancelled by the caller don't count as failures.
+func NewBreakerRecommender(rec Recommender, threshold int, cooldown time.Duration) Recommender {
+	return &breakerRecommender{
+		rec:       rec,
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+}
+
+func (b *breakerRecommender) Recommend(ctx context.Context, user string) (Movie, error) {
+	b.mu.Lock()
+	probe := false
+	if !b.openUntil.IsZero() {
+		if b.probing || time.Now().Before(b.openUntil) {
+			b.mu.Unlock()
+			return Movie{}, ErrBreakerOpen
+		}
+		// Probe, keep others out until it's done
+		b.probing, probe = true, true
+	}
+	b.mu.Unlock()
+
+	m, err := b.rec.Recommend(ctx, user)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		return Movie{}, err // the caller gave up, rec didn't fail
+	}
+	if err != nil {
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+		return Movie{}, err
+	}
+
+	b.failures = 0
+	b.openUntil = time.Time{}
+	return m, nil
+}
+
+// cachedRecommender caches successful recommendations per user.
+type cachedRecommender struct {
+	rec  Recommender
+	ttl  time.Duration
+	size int
+
+	mu sync.Mutex
+	m  map[string]cachedMovie
+}
+
+type cachedMovie struct {
+	movie      Movie
+	expiration time.Time
+}
+
+// NewCachedRecommender returns a Recommender that calls rec only if there's no
+// recommendation for the user from the last ttl. Failures are not cached.
+// At most size users are kept, when full the recommendation closest to expiring is evicted.
+func NewCachedRecommender(rec Recommender, ttl time.Duration, size int) Recommender {
+	return &cachedRecommender{
+		rec:  rec,
+		ttl:  ttl,
+		size: max(size, 1),
+		m:    make(map[string]cachedMovie),
+	}
+}
+
+func (c *cachedRecommender) Recommend(ctx context.Context, user string) (Movie, error) {
+	c.mu.Lock()
+	cm, found := c.m[user]
+	if found && !time.Now().Before(cm.expiration) {
+		delete(c.m, user)
+		found = false
+	}
+	c.mu.Unlock()
+	if found {
+		return cm.movie, nil
+	}
+
+	m, err := c.rec.Recommend(ctx, user)
+	if err != nil {
+		return Movie{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[user]; !ok && len(c.m) >= c.size {
+		c.evict()
+	}
+	c.m[user] = cachedMovie{movie: m, expiration: time.Now().Add(c.ttl)}
+	return m, nil
+}
+
+// evict drops expired entries, or the one closest to expiring if none has expired.
+// c.mu must be held.
+func (c *cachedRecommender) evict() {
+	now := time.Now()
+	var oldest string
+	var oldestExp time.Time
+	for user, cm := range c.m {
+		if !now.Before(cm.expiration) {
+			delete(c.m, user)
+			continue
+		}
+		if oldestExp.IsZero() || cm.expiration.Before(oldestExp) {
+			oldest, oldestExp = user, cm.expiration
+		}
+	}
+	if len(c.m) >= c.size {
+		delete(c.m, oldest)
 	}
 }
 
-// NextMovie return BestNextMovie result if it finished before ctx expires, otherwise defaultMovie
-func NextMovie(ctx context.Context, user string) Movie {
-	ch := make(chan Movie, 1)
+type reply struct {
+	movie Movie
+	err   error
+}
+
+// recommend returns rec recommendation, or ctx error if ctx expires first.
+// The context passed to rec is cancelled once recommend returns, so rec can stop working.
+func recommend(ctx context.Context, rec Recommender, user string) (Movie, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan reply, 1)
 
 	go func() {
-		ch <- BestNextMovie(user)
+		m, err := rec.Recommend(ctx, user)
+		ch <- reply{m, err}
 	}()
 
 	select {
-	case m := <-ch:
-		return m
+	case r := <-ch:
+		return r.movie, r.err
 	case <-ctx.Done():
-		log.Printf("warn: context expired: %v", ctx.Err())
-		return defaultMovie
+		return Movie{}, ctx.Err()
+	}
+}
+
+// NextMovie return rec recommendation if it finished before ctx expires, otherwise defaultMovie.
+// defaultMovie is also returned if rec fails. The bool is false when defaultMovie is returned.
+func NextMovie(ctx context.Context, rec Recommender, user string) (Movie, bool) {
+	return NextMovieWith(ctx, rec, user)
+}
+
+type options struct {
+	fallback Movie
+	onResult func(user string, m Movie, d time.Duration, timedOut bool)
+}
+
+// Option configures NextMovieWith and the other functions that fall back to a default movie.
+type Option func(*options)
+
+// WithFallback sets the movie returned when there's no recommendation, default is defaultMovie.
+func WithFallback(m Movie) Option {
+	return func(o *options) {
+		o.fallback = m
+	}
+}
+
+// WithOnResult sets fn to be called at the end of every call with the returned movie, how
+// long the call took and whether it timed out. fn can't change the returned value.
+func WithOnResult(fn func(user string, m Movie, d time.Duration, timedOut bool)) Option {
+	return func(o *options) {
+		o.onResult = fn
+	}
+}
+
+// NextMovieWith is NextMovie configured by opts.
+func NextMovieWith(ctx context.Context, rec Recommender, user string, opts ...Option) (Movie, bool) {
+	o := newOptions(opts)
+	start := time.Now()
+	m, err := recommend(ctx, rec, user)
+	ok := err == nil
+	if !ok {
+		log.Printf("warn: can't recommend: %v", err)
+	}
+	return o.result(user, m, start, err), ok
+}
+
+func newOptions(opts []Option) options {
+	o := options{fallback: defaultMovie}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// result returns m, or the fallback if err is not nil, and reports it to onResult.
+func (o options) result(user string, m Movie, start time.Time, err error) Movie {
+	if err != nil {
+		m = o.fallback
+	}
+	if o.onResult != nil {
+		o.onResult(user, m, time.Since(start), errors.Is(err, context.DeadlineExceeded))
+	}
+	return m
+}
+
+// NextMovies returns a recommendation for every user in users, fetched concurrently.
+// Users whose recommendation isn't ready before ctx expires (or fails) get defaultMovie,
+// or the WithFallback movie.
+func NextMovies(ctx context.Context, rec Recommender, users []string, opts ...Option) map[string]Movie {
+	movies := make(map[string]Movie, len(users))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	wg.Add(len(users))
+	for _, user := range users {
+		go func() {
+			defer wg.Done()
+			m, _ := NextMovieWith(ctx, rec, user, opts...)
+
+			mu.Lock()
+			defer mu.Unlock()
+			movies[user] = m
+		}()
+	}
+	wg.Wait()
+
+	return movies
+}
+
+// NextMovieChain tries recs in order, moving to the next one on error or timeout.
+// If ctx has a deadline, each recommender gets an equal share of the time left, otherwise
+// each one may take until ctx is done. defaultMovie is returned if all recommenders fail.
+func NextMovieChain(ctx context.Context, user string, recs ...Recommender) Movie {
+	return NextMovieChainWith(ctx, user, recs)
+}
+
+// NextMovieChainWith is NextMovieChain configured by opts.
+func NextMovieChainWith(ctx context.Context, user string, recs []Recommender, opts ...Option) Movie {
+	o := newOptions(opts)
+	start := time.Now()
+	err := errors.New("no recommenders")
+	for i, rec := range recs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			budget := time.Until(deadline) / time.Duration(len(recs)-i)
+			stepCtx, cancel = context.WithTimeout(ctx, budget)
+		}
+
+		var m Movie
+		m, err = recommend(stepCtx, rec, user)
+		cancel()
+		if err == nil {
+			return o.result(user, m, start, nil)
+		}
+		log.Printf("warn: recommender %d: can't recommend: %v", i, err)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return o.result(user, Movie{}, start, err)
+}
+
+// FastestMovie runs all recs concurrently and returns the first successful recommendation,
+// the others are cancelled. If all recs fail or ctx expires first, it returns
+// defaultMovie and the error.
+func FastestMovie(ctx context.Context, user string, recs ...Recommender) (Movie, error) {
+	return FastestMovieWith(ctx, user, recs)
+}
+
+// FastestMovieWith is FastestMovie configured by opts.
+func FastestMovieWith(ctx context.Context, user string, recs []Recommender, opts ...Option) (Movie, error) {
+	o := newOptions(opts)
+	start := time.Now()
+	m, err := fastestMovie(ctx, user, recs)
+	return o.result(user, m, start, err), err
+}
+
+func fastestMovie(ctx context.Context, user string, recs []Recommender) (Movie, error) {
+	if len(recs) == 0 {
+		return Movie{}, errors.New("no recommenders")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop the losers
+
+	ch := make(chan reply, len(recs)) // buffered so losers can always send and exit
+	for _, rec := range recs {
+		go func() {
+			m, err := rec.Recommend(ctx, user)
+			ch <- reply{m, err}
+		}()
+	}
+
+	var errs []error
+	for range recs {
+		select {
+		case r := <-ch:
+			if r.err == nil {
+				return r.movie, nil
+			}
+			errs = append(errs, r.err)
+		case <-ctx.Done():
+			return Movie{}, ctx.Err()
+		}
+	}
+
+	return Movie{}, errors.Join(errs...)
+}
+
+// HedgedMovie calls rec and, if it hasn't answered after hedgeAfter, calls it again.
+// The first successful answer is returned and the other call is cancelled. If the first
+// call fails before hedgeAfter, the second one starts right away. If both calls fail
+// or ctx expires first, it returns defaultMovie (or the WithFallback movie) and the error.
+func HedgedMovie(ctx context.Context, user string, rec Recommender, hedgeAfter time.Duration, opts ...Option) (Movie, error) {
+	o := newOptions(opts)
+	start := time.Now()
+	m, err := hedgedMovie(ctx, user, rec, hedgeAfter)
+	return o.result(user, m, start, err), err
+}
+
+func hedgedMovie(ctx context.Context, user string, rec Recommender, hedgeAfter time.Duration) (Movie, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop the slower call
+
+	ch := make(chan reply, 2) // buffered so the slower call can always send and exit
+	call := func() {
+		m, err := rec.Recommend(ctx, user)
+		ch <- reply{m, err}
 	}
+
+	go call()
+	pending, hedged := 1, false
+	timer := time.NewTimer(hedgeAfter)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-ch:
+			pending--
+			if r.err == nil {
+				return r.movie, nil
+			}
+			errs = append(errs, r.err)
+			if !hedged {
+				hedged = true
+				pending++
+				go call()
+			}
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				go call()
+			}
+		case <-ctx.Done():
+			return Movie{}, ctx.Err()
+		}
+	}
+
+	return Movie{}, errors.Join(errs...)
 }
 
 func main() {
@@ -55,6 +459,6 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), bmvTime/2)
 	defer cancel()
 
-	mTimeout := NextMovie(ctx, "ridley")
-	log.Printf("info: got %+v", mTimeout)
+	mTimeout, ok := NextMovie(ctx, staticRecommender{}, "ridley")
+	log.Printf("info: got %+v (ok=%v)", mTimeout, ok)
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	blade  = Movie{ID: "tt0083658", Title: "Blade Runner"}
+	alien  = Movie{ID: "tt0078748", Title: "Alien"}
+	errRec = errors.New("can't recommend")
+)
+
+// sleepy returns a Recommender that answers m after d, or fails once ctx is done.
+func sleepy(m Movie, d time.Duration) Recommender {
+	return RecommenderFunc(func(ctx context.Context, user string) (Movie, error) {
+		select {
+		case <-time.After(d):
+			return m, nil
+		case <-ctx.Done():
+			return Movie{}, ctx.Err()
+		}
+	})
+}
+
+// failing returns a Recommender that fails right away, counting its calls.
+func failing(calls *atomic.Int64) Recommender {
+	return RecommenderFunc(func(context.Context, string) (Movie, error) {
+		if calls != nil {
+			calls.Add(1)
+		}
+		return Movie{}, errRec
+	})
+}
+
+func TestNextMovieChain(t *testing.T) {
+	var calls atomic.Int64
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m := NextMovieChain(ctx, "ridley", failing(&calls), sleepy(alien, time.Millisecond), staticRecommender{})
+	if m != alien {
+		t.Fatalf("got %v, want %v", m, alien)
+	}
+	if calls.Load() != 1 {
+		t.Fatal("first recommender not called")
+	}
+}
+
+func TestNextMovieChainBudget(t *testing.T) {
+	// the first recommender gets half of the time and times out, leaving the
+	// other half to the second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	m := NextMovieChain(ctx, "ridley", sleepy(blade, time.Second), sleepy(alien, 10*time.Millisecond))
+	if m != alien {
+		t.Fatalf("got %v, want %v", m, alien)
+	}
+}
+
+func TestNextMovieNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 20 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		NextMovie(ctx, staticRecommender{}, "ridley")
+		cancel()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines left, %d before", n, before)
+	}
+}
+
+func TestNextMovie(t *testing.T) {
+	tests := []struct {
+		name    string
+		rec     Recommender
+		timeout time.Duration
+		want    Movie
+		ok      bool
+	}{
+		{"in time", staticRecommender{}, 2 * bmvTime, blade, true},
+		{"timeout", staticRecommender{}, bmvTime / 2, defaultMovie, false},
+		{"error", failing(nil), time.Second, defaultMovie, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+
+			m, ok := NextMovie(ctx, tc.rec, "ridley")
+			if m != tc.want || ok != tc.ok {
+				t.Fatalf("got %v, %v, want %v, %v", m, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestRecommenderFunc(t *testing.T) {
+	var gotUser string
+	rec := RecommenderFunc(func(ctx context.Context, user string) (Movie, error) {
+		gotUser = user
+		return alien, nil
+	})
+
+	m, err := rec.Recommend(context.Background(), "ridley")
+	if err != nil || m != alien || gotUser != "ridley" {
+		t.Fatalf("got %v, %v for user %q", m, err, gotUser)
+	}
+}
+
+func TestFastestMovie(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := FastestMovie(ctx, "ridley", sleepy(blade, time.Second), failing(nil), sleepy(alien, time.Millisecond))
+	if err != nil || m != alien {
+		t.Fatalf("got %v, %v, want %v", m, err, alien)
+	}
+
+	m, err = FastestMovie(ctx, "ridley", failing(nil), failing(nil))
+	if !errors.Is(err, errRec) || m != defaultMovie {
+		t.Fatalf("got %v, %v, want defaultMovie and %v", m, err, errRec)
+	}
+}
+
+func TestHedgedMovie(t *testing.T) {
+	var calls atomic.Int64
+	// the first call is slow, the hedge is fast
+	rec := RecommenderFunc(func(ctx context.Context, user string) (Movie, error) {
+		if calls.Add(1) == 1 {
+			return sleepy(blade, time.Second).Recommend(ctx, user)
+		}
+		return alien, nil
+	})
+
+	start := time.Now()
+	m, err := HedgedMovie(context.Background(), "ridley", rec, 10*time.Millisecond)
+	if err != nil || m != alien {
+		t.Fatalf("got %v, %v, want %v", m, err, alien)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("took %v, hedge didn't win", d)
+	}
+
+	calls.Store(0)
+	if _, err := HedgedMovie(context.Background(), "ridley", failing(&calls), time.Hour); !errors.Is(err, errRec) {
+		t.Fatalf("err = %v, want %v", err, errRec)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls, want 2: a failure must hedge right away", n)
+	}
+}
+
+func TestNextMovieWith(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), bmvTime/2)
+	defer cancel()
+
+	m, ok := NextMovieWith(ctx, staticRecommender{}, "ridley", WithFallback(alien))
+	if m != alien || ok {
+		t.Fatalf("got %v, %v, want the fallback", m, ok)
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	ctx := context.Background()
+
+	if m := NextMovieChainWith(ctx, "ridley", []Recommender{failing(nil)}, WithFallback(blade)); m != blade {
+		t.Fatalf("chain: got %v, want the fallback", m)
+	}
+	if m, err := FastestMovieWith(ctx, "ridley", nil, WithFallback(alien)); err == nil || m != alien {
+		t.Fatalf("fastest: got %v, %v, want the fallback and an error", m, err)
+	}
+	if m, err := HedgedMovie(ctx, "ridley", failing(nil), time.Hour, WithFallback(blade)); err == nil || m != blade {
+		t.Fatalf("hedged: got %v, %v, want the fallback and an error", m, err)
+	}
+}
+
+func TestNextMovies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*bmvTime)
+	defer cancel()
+
+	users := []string{"a", "b", "c"}
+	start := time.Now()
+	movies := NextMovies(ctx, staticRecommender{}, users)
+	if d := time.Since(start); d > 2*bmvTime {
+		t.Fatalf("took %v, users not concurrent", d)
+	}
+	for _, u := range users {
+		if movies[u] != blade {
+			t.Fatalf("%s: got %v", u, movies[u])
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), bmvTime/2)
+	defer cancel()
+	movies = NextMovies(ctx, staticRecommender{}, users, WithFallback(alien))
+	for _, u := range users {
+		if movies[u] != alien {
+			t.Fatalf("%s: got %v, want the fallback", u, movies[u])
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var calls atomic.Int64
+	var fail atomic.Bool
+	fail.Store(true)
+	rec := RecommenderFunc(func(context.Context, string) (Movie, error) {
+		calls.Add(1)
+		if fail.Load() {
+			return Movie{}, errRec
+		}
+		return blade, nil
+	})
+
+	cooldown := 20 * time.Millisecond
+	b := NewBreakerRecommender(rec, 2, cooldown)
+	ctx := context.Background()
+
+	for range 2 {
+		if _, err := b.Recommend(ctx, "ridley"); !errors.Is(err, errRec) {
+			t.Fatalf("err = %v, want %v", err, errRec)
+		}
+	}
+	if _, err := b.Recommend(ctx, "ridley"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("err = %v, want %v", err, ErrBreakerOpen)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls, want 2", n)
+	}
+
+	time.Sleep(cooldown)
+	fail.Store(false)
+	if m, err := b.Recommend(ctx, "ridley"); err != nil || m != blade {
+		t.Fatalf("probe: got %v, %v", m, err)
+	}
+	if _, err := b.Recommend(ctx, "ridley"); err != nil {
+		t.Fatalf("breaker not closed: %v", err)
+	}
+}
+
+func TestBreakerCallerCancel(t *testing.T) {
+	b := NewBreakerRecommender(sleepy(blade, time.Second), 1, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Recommend(ctx, "ridley"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	b = NewBreakerRecommender(sleepy(blade, time.Millisecond), 1, time.Hour)
+	b.Recommend(ctx, "ridley")
+	if _, err := b.Recommend(context.Background(), "ridley"); err != nil {
+		t.Fatalf("caller cancellation opened the breaker: %v", err)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	var calls atomic.Int64
+	failFirst := RecommenderFunc(func(ctx context.Context, user string) (Movie, error) {
+		if calls.Add(1) == 1 {
+			return Movie{}, errRec
+		}
+		// the probe outlasts the cooldown
+		return sleepy(blade, 50*time.Millisecond).Recommend(ctx, user)
+	})
+
+	cooldown := 5 * time.Millisecond
+	b := NewBreakerRecommender(failFirst, 1, cooldown)
+	ctx := context.Background()
+	b.Recommend(ctx, "ridley")
+	time.Sleep(cooldown)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Recommend(ctx, "ridley")
+		}()
+		time.Sleep(2 * cooldown)
+	}
+	wg.Wait()
+
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls, want 2: only one probe may run", n)
+	}
+}
+
+func TestCachedRecommender(t *testing.T) {
+	var calls atomic.Int64
+	rec := RecommenderFunc(func(context.Context, string) (Movie, error) {
+		calls.Add(1)
+		return blade, nil
+	})
+	ttl := 20 * time.Millisecond
+	c := NewCachedRecommender(rec, ttl, 10)
+	ctx := context.Background()
+
+	c.Recommend(ctx, "ridley")
+	c.Recommend(ctx, "ridley")
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("%d calls, want 1", n)
+	}
+
+	time.Sleep(ttl)
+	c.Recommend(ctx, "ridley")
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls after ttl, want 2", n)
+	}
+}
+
+func TestCachedRecommenderSize(t *testing.T) {
+	var calls atomic.Int64
+	rec := RecommenderFunc(func(context.Context, string) (Movie, error) {
+		calls.Add(1)
+		return blade, nil
+	})
+	c := NewCachedRecommender(rec, time.Hour, 2).(*cachedRecommender)
+	ctx := context.Background()
+
+	for _, user := range []string{"a", "b", "c"} {
+		c.Recommend(ctx, user)
+	}
+	if n := len(c.m); n != 2 {
+		t.Fatalf("%d cached users, want 2", n)
+	}
+
+	c.Recommend(ctx, "a") // evicted as the oldest
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("%d calls, want 4", n)
+	}
+}
+
+func TestCachedRecommenderErrors(t *testing.T) {
+	var calls atomic.Int64
+	c := NewCachedRecommender(failing(&calls), time.Hour, 10)
+
+	c.Recommend(context.Background(), "ridley")
+	c.Recommend(context.Background(), "ridley")
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls, want 2: failures must not be cached", n)
+	}
+}
+
+func TestNextMovieWithOnResult(t *testing.T) {
+	var (
+		gotUser     string
+		gotMovie    Movie
+		gotTimedOut bool
+	)
+	onResult := func(user string, m Movie, d time.Duration, timedOut bool) {
+		gotUser, gotMovie, gotTimedOut = user, m, timedOut
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bmvTime/2)
+	defer cancel()
+	NextMovieWith(ctx, staticRecommender{}, "ridley", WithFallback(alien), WithOnResult(onResult))
+	if gotUser != "ridley" || gotMovie != alien || !gotTimedOut {
+		t.Fatalf("onResult got %q, %v, %v", gotUser, gotMovie, gotTimedOut)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*bmvTime)
+	defer cancel()
+	NextMovieWith(ctx, staticRecommender{}, "ridley", WithOnResult(onResult))
+	if gotMovie != blade || gotTimedOut {
+		t.Fatalf("onResult got %v, %v, want %v in time", gotMovie, gotTimedOut, blade)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Compare returns how similar a and b, which must be the same size, are.
+// The score is 1 minus the root mean squared error of the RGBA channels, normalized to
+// [0, 1]: 1 means identical and lower values mean more different images.
+func Compare(a, b image.Image) (float64, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return 0, fmt.Errorf("size mismatch: %v != %v", ab.Size(), bb.Size())
+	}
+
+	n := ab.Dx() * ab.Dy() * 4
+	if n == 0 {
+		return 1, nil
+	}
+
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, a1 := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range [4]float64{
+				float64(r1) - float64(r2),
+				float64(g1) - float64(g2),
+				float64(b1) - float64(b2),
+				float64(a1) - float64(a2),
+			} {
+				sum += d * d
+			}
+		}
+	}
+
+	rmse := math.Sqrt(sum / float64(n))
+	return 1 - rmse/0xffff, nil
+}
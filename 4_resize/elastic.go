@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WithElastic makes CenterDir start with a single worker and add workers, up to n, while
+// jobs wait for a free one. Workers idle for idle exit, down to a single one.
+func WithElastic(idle time.Duration) Option {
+	return func(o *options) {
+		o.idle = idle
+	}
+}
+
+// elastic tracks the number of workers of an elastic pool.
+type elastic struct {
+	max   int
+	idle  time.Duration
+	spawn func() // starts a worker
+
+	workers atomic.Int64
+	peak    atomic.Int64
+}
+
+// grow starts a new worker unless there are max already, it reports if it did.
+func (e *elastic) grow() bool {
+	for {
+		n := e.workers.Load()
+		if n >= int64(e.max) {
+			return false
+		}
+		if e.workers.CompareAndSwap(n, n+1) {
+			for p := e.peak.Load(); n+1 > p && !e.peak.CompareAndSwap(p, n+1); p = e.peak.Load() {
+			}
+			e.spawn()
+			return true
+		}
+	}
+}
+
+// shrink reports if an idle worker may exit, which it must do if true. The last worker
+// never exits so queued jobs are always done.
+func (e *elastic) shrink() bool {
+	for {
+		n := e.workers.Load()
+		if n <= 1 {
+			return false
+		}
+		if e.workers.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
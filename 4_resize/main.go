@@ -1,102 +1,993 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
-func worker(ctx context.Context, jobs <-chan [2]string, results chan<- error) {
+// Progress is sent by CenterDir after each file is done.
+type Progress struct {
+	Done    int    // number of files done so far
+	Total   int    // total number of files
+	Current string // source file that was just done
+}
+
+type options struct {
+	progress    chan<- Progress
+	quality     int
+	format      string
+	background  color.Color
+	dryRun      bool
+	incremental bool
+	grayscale   bool
+	rate        int
+	recursive   bool
+	modTime     bool
+	budget      time.Duration
+	maxDecodes  int           // WithMaxDecodes limit, 0 means no limit
+	idle        time.Duration // WithElastic idle timeout, 0 means a fixed pool
+	watermark   *watermark
+	logger      *slog.Logger
+
+	// transform is applied to every image, Center crops and ConvertDir copies.
+	// The returned image is put back with putRGBA once encoded.
+	transform func(image.Image) *image.RGBA
+	// decodes limits the number of concurrent decodes (a semaphore), nil means no limit.
+	decodes chan struct{}
+}
+
+// extensions maps supported output formats to their file extension.
+var extensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// Option configures Center, Scale and CenterDir.
+type Option func(*options)
+
+// newOptions applies opts over the defaults and validates the result.
+func newOptions(opts []Option) (options, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.quality == 0 {
+		o.quality = jpeg.DefaultQuality
+	}
+	if o.watermark != nil && o.watermark.img == nil {
+		return o, fmt.Errorf("nil watermark image")
+	}
+	if o.watermark != nil && (o.watermark.opacity < 0 || o.watermark.opacity > 1) {
+		return o, fmt.Errorf("watermark opacity must be in [0, 1], got %v", o.watermark.opacity)
+	}
+	if o.rate < 0 {
+		return o, fmt.Errorf("rate must not be negative, got %d", o.rate)
+	}
+	if o.maxDecodes < 0 {
+		return o, fmt.Errorf("max decodes must not be negative, got %d", o.maxDecodes)
+	}
+	if o.idle < 0 {
+		return o, fmt.Errorf("idle timeout must not be negative, got %v", o.idle)
+	}
+	if o.budget < 0 {
+		return o, fmt.Errorf("budget must not be negative, got %v", o.budget)
+	}
+	if o.quality < 1 || o.quality > 100 {
+		return o, fmt.Errorf("quality must be in 1-100, got %d", o.quality)
+	}
+
+	if o.logger == nil {
+		o.logger = slog.New(slog.DiscardHandler)
+	}
+	if o.background == nil {
+		o.background = color.Black
+	}
+	if o.transform == nil {
+		o.transform = crop
+	}
+
+	switch o.format {
+	case "", "jpg":
+		o.format = "jpeg"
+	}
+	if _, ok := extensions[o.format]; !ok {
+		return o, fmt.Errorf("unsupported format: %q", o.format)
+	}
+	return o, nil
+}
+
+// WithProgress sends a Progress on ch after each file is done.
+// Sends don't block, if ch is not ready the update is dropped. Use a buffered channel
+// to get every update.
+func WithProgress(ch chan<- Progress) Option {
+	return func(o *options) {
+		o.progress = ch
+	}
+}
+
+// WithQuality sets the JPEG encoding quality (1-100), default is jpeg.DefaultQuality.
+func WithQuality(quality int) Option {
+	return func(o *options) {
+		o.quality = quality
+	}
+}
+
+// WithFormat sets the output format: "jpeg" (default), "png" or "gif".
+// CenterDir changes the extension of output files to match the format.
+func WithFormat(format string) Option {
+	return func(o *options) {
+		o.format = format
+	}
+}
+
+// WithBackground sets the color Fit uses to fill around the image, default is black.
+func WithBackground(c color.Color) Option {
+	return func(o *options) {
+		o.background = c
+	}
+}
+
+// WithDryRun makes CenterDir go over the files and report progress without
+// creating destDir or writing any file. CenterDirReport lists the planned files in
+// Report.Planned.
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
+
+// WithIncremental makes CenterDir skip source files whose output already exists and
+// is newer than the source.
+func WithIncremental() Option {
+	return func(o *options) {
+		o.incremental = true
+	}
+}
+
+// WithGrayscale makes the output grayscale.
+func WithGrayscale() Option {
+	return func(o *options) {
+		o.grayscale = true
+	}
+}
+
+// WithRate limits CenterDir to start at most rate files per second, 0 means no limit.
+func WithRate(rate int) Option {
+	return func(o *options) {
+		o.rate = rate
+	}
+}
+
+// WithMaxDecodes limits CenterDir to decode at most k images at once, whatever the
+// number of workers: decoded images take most of the memory, so this bounds the peak
+// while the other workers encode and write. 0 means no limit.
+func WithMaxDecodes(k int) Option {
+	return func(o *options) {
+		o.maxDecodes = k
+	}
+}
+
+// WithRecursive makes CenterDir process images in sub directories of srcDir as well,
+// outputs are written to the same sub directories under destDir.
+func WithRecursive() Option {
+	return func(o *options) {
+		o.recursive = true
+	}
+}
+
+// ErrBudgetExceeded is returned by CenterDir when it stopped starting new files since
+// the WithBudget time was up.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// WithBudget makes CenterDir stop starting new files once it ran for d. Files already
+// started are finished, the others are left out and ErrBudgetExceeded is returned.
+// Unlike a context deadline, work in progress isn't cancelled.
+func WithBudget(d time.Duration) Option {
+	return func(o *options) {
+		o.budget = d
+	}
+}
+
+// WithPreserveModTime sets the modification time of outputs to the one of their source,
+// so copies sort like the originals.
+func WithPreserveModTime() Option {
+	return func(o *options) {
+		o.modTime = true
+	}
+}
+
+// Position is a corner of an image.
+type Position int
+
+const (
+	TopLeft Position = iota
+	TopRight
+	BottomLeft
+	BottomRight
+)
+
+type watermark struct {
+	img     image.Image
+	pos     Position
+	opacity float64
+}
+
+// WithWatermark draws img over the corner pos of the output, with opacity in [0, 1].
+// A watermark larger than the output is clipped.
+func WithWatermark(img image.Image, pos Position, opacity float64) Option {
+	return func(o *options) {
+		o.watermark = &watermark{img: img, pos: pos, opacity: opacity}
+	}
+}
+
+// draw draws the watermark over dest.
+func (w *watermark) draw(dest draw.Image) {
+	db, size := dest.Bounds(), w.img.Bounds().Size()
+
+	var at image.Point
+	switch w.pos {
+	case TopLeft:
+		at = db.Min
+	case TopRight:
+		at = image.Point{db.Max.X - size.X, db.Min.Y}
+	case BottomLeft:
+		at = image.Point{db.Min.X, db.Max.Y - size.Y}
+	case BottomRight:
+		at = db.Max.Sub(size)
+	}
+
+	r := image.Rectangle{at, at.Add(size)}
+	mask := image.NewUniform(color.Alpha{uint8(math.Round(w.opacity * 255))})
+	draw.DrawMask(dest, r, w.img, w.img.Bounds().Min, mask, image.Point{}, draw.Over)
+}
+
+// WithLogger sets the logger, by default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// result is the outcome of a single job
+type result struct {
+	src     string
+	dest    string
+	err     error
+	skipped bool
+}
+
+// worker processes jobs until jobs is closed or ctx is done. In an elastic pool (e is not
+// nil) it may exit after being idle.
+func worker(ctx context.Context, jobs <-chan [2]string, results chan<- result, o options, e *elastic) {
+	var timer *time.Timer
+	var idle <-chan time.Time // nil, never ready, in a fixed pool
+	if e != nil {
+		timer = time.NewTimer(e.idle)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-idle:
+			if e.shrink() {
+				return
+			}
+			timer.Reset(e.idle)
 		case job, ok := <-jobs:
 			if !ok {
 				return
 			}
-			err := Center(job[0], job[1])
-			results <- err
+			var err error
+			if !o.dryRun {
+				err = os.MkdirAll(filepath.Dir(job[1]), 0750) // sub directory in recursive mode
+				if err == nil {
+					err = safeCenter(ctx, job[0], job[1], o)
+				}
+			}
+			results <- result{src: job[0], dest: job[1], err: err}
+			if timer != nil {
+				timer.Reset(e.idle)
+			}
 		}
 	}
 }
 
-func producer(ctx context.Context, jobs chan<- [2]string, srcDir, destDir string) error {
-	defer close(jobs)
+// maxStack is the maximal size of the stack trace in a recovered panic error
+const maxStack = 2048
 
-	matches, err := filepath.Glob(fmt.Sprintf("%s/*.jpg", srcDir))
+// safeCenter calls center, converting a panic (e.g. from a malformed image) to an error.
+func safeCenter(ctx context.Context, srcFile, destFile string, o options) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			stack := debug.Stack()
+			if len(stack) > maxStack {
+				stack = stack[:maxStack]
+			}
+			err = fmt.Errorf("panic: %v\n%s", v, stack)
+		}
+	}()
+
+	return center(ctx, srcFile, destFile, o)
+}
+
+// destPath returns the path in destDir for src, which is in (a sub directory of) srcDir,
+// with the extension replaced by ext.
+func destPath(srcDir, destDir, src, ext string) string {
+	rel, err := filepath.Rel(srcDir, src)
 	if err != nil {
-		return err
+		rel = filepath.Base(src)
+	}
+	rel = rel[:len(rel)-len(filepath.Ext(rel))] + ext
+	return filepath.Join(destDir, rel)
+}
+
+// sources returns the files in srcDir whose name match one of patterns, ignoring case
+// (patterns must be lower case) so "cat.JPG" matches "*.jpg". Files are in lexical order.
+// If recursive, sub directories are searched as well.
+func sources(srcDir string, patterns []string, recursive bool) ([]string, error) {
+	match := func(name string) bool {
+		name = strings.ToLower(name)
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	var matches []string
+	if !recursive {
+		entries, err := os.ReadDir(srcDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && match(e.Name()) {
+				matches = append(matches, filepath.Join(srcDir, e.Name()))
+			}
+		}
+		return matches, nil
+	}
+
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if match(d.Name()) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// upToDate returns true if dest exists and is not older than src (it has the same
+// modification time WithPreserveModTime).
+func upToDate(src, dest string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return false
+	}
+	return !destInfo.ModTime().Before(srcInfo.ModTime())
+}
+
+// producer sends a job for every file in matches, until ctx is done or budget fires
+// (nil means no budget). In an elastic pool (e is not nil) it adds a worker when no
+// worker is free.
+func producer(ctx context.Context, jobs chan<- [2]string, results chan<- result, matches []string, srcDir, destDir string, budget <-chan time.Time, o options, e *elastic) error {
+	defer close(jobs)
+
+	var tick <-chan time.Time
+	// above 1e9 files per second the interval rounds to 0, which is no limit
+	if o.rate > 0 && o.rate <= int(time.Second) {
+		ticker := time.NewTicker(time.Second / time.Duration(o.rate))
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
+	srcOf := make(map[string]string) // dest -> src, to catch e.g. cat.jpg and cat.png
 	for _, src := range matches {
-		dest := fmt.Sprintf("%s/%s", destDir, filepath.Base(src))
+		dest := destPath(srcDir, destDir, src, extensions[o.format])
+		if other, ok := srcOf[dest]; ok {
+			err := fmt.Errorf("same output %s as %s", dest, other)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case results <- result{src: src, dest: dest, err: err}:
+			}
+			continue
+		}
+		srcOf[dest] = src
+
+		if o.incremental && upToDate(src, dest) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case results <- result{src: src, dest: dest, skipped: true}:
+			}
+			continue
+		}
+
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-budget:
+				return ErrBudgetExceeded
+			case <-tick:
+			}
+		}
+
+		// select picks at random among ready cases, check the stop conditions first so
+		// a free worker doesn't get jobs after the budget or ctx is done
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-budget:
+			return ErrBudgetExceeded
+		default:
+		}
+
+		job := [2]string{src, dest}
+		if e != nil {
+			select {
+			case jobs <- job:
+				continue
+			default: // all workers busy
+				e.grow()
+			}
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case jobs <- [2]string{src, dest}:
+		case <-budget:
+			return ErrBudgetExceeded
+		case jobs <- job:
 		}
 	}
 
 	return nil
 }
 
+// decode decodes the image (JPEG, PNG or GIF) in data and rotates it upright according
+// to its EXIF orientation.
+func decode(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return orient(img, orientation(data)), nil
+}
+
+// limitedDecode is decode that waits for a slot in sem first, peak memory depends
+// on the number of images decoded at once.
+func limitedDecode(ctx context.Context, data []byte, sem chan struct{}) (image.Image, error) {
+	if sem != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case sem <- struct{}{}:
+		}
+		defer func() { <-sem }()
+	}
+
+	return decodeImage(data)
+}
+
+// decodeImage is the decode used by limitedDecode, a variable so tests can observe it.
+var decodeImage = decode
+
+// load decodes the image in srcFile, see decode.
+func load(srcFile string) (image.Image, error) {
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(data)
+}
+
+// rgbaPools holds a *sync.Pool of *image.RGBA for every image size.
+var rgbaPools sync.Map // image.Point -> *sync.Pool
+
+// getRGBA returns a w x h image from the pool. The pixels are not cleared, callers must
+// overwrite all of them.
+func getRGBA(w, h int) *image.RGBA {
+	size := image.Point{w, h}
+	p, ok := rgbaPools.Load(size)
+	if !ok {
+		p, _ = rgbaPools.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				return image.NewRGBA(image.Rect(0, 0, w, h))
+			},
+		})
+	}
+	return p.(*sync.Pool).Get().(*image.RGBA)
+}
+
+// putRGBA returns img, which was created by getRGBA, to the pool.
+func putRGBA(img *image.RGBA) {
+	if p, ok := rgbaPools.Load(img.Bounds().Size()); ok {
+		p.(*sync.Pool).Put(img)
+	}
+}
+
+// crop returns the center of src, the result is from getRGBA.
+func crop(src image.Image) *image.RGBA {
+	x, y := src.Bounds().Max.X, src.Bounds().Max.Y
+	dest := getRGBA(x/2, y/2)
+	draw.Draw(dest, dest.Bounds(), src, image.Point{x / 4, y / 4}, draw.Src)
+	return dest
+}
+
+// convert returns a copy of src, the result is from getRGBA.
+func convert(src image.Image) *image.RGBA {
+	dest := getRGBA(src.Bounds().Dx(), src.Bounds().Dy())
+	draw.Draw(dest, dest.Bounds(), src, src.Bounds().Min, draw.Src)
+	return dest
+}
+
 // Center creates destFile which is the center of image encode in data.
-func Center(srcFile, destFile string) error {
+// Center crops, it discards everything outside the middle of the image. Use Scale to
+// keep the whole image.
+func Center(srcFile, destFile string, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	return center(context.Background(), srcFile, destFile, o)
+}
+
+// ctxWriter fails writes once ctx is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// center is Center that gives up when ctx is done, without leaving a partial destFile.
+func center(ctx context.Context, srcFile, destFile string, o options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	file, err := os.Open(srcFile)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	src, err := jpeg.Decode(file)
+	err = writeAtomic(destFile, func(out io.Writer) error {
+		return centerStream(ctx, &ctxWriter{ctx: ctx, w: out}, file, o)
+	})
 	if err != nil {
 		return err
 	}
 
-	x, y := src.Bounds().Max.X, src.Bounds().Max.Y
-	r := image.Rect(0, 0, x/2, y/2)
-	dest := image.NewRGBA(r)
-	draw.Draw(dest, dest.Bounds(), src, image.Point{x / 4, y / 4}, draw.Over)
+	if o.modTime {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		// zero access time leaves it unchanged
+		return os.Chtimes(destFile, time.Time{}, info.ModTime())
+	}
+	return nil
+}
 
-	out, err := os.Create(destFile)
+// CenterStream is like Center but reads the image from src and writes the result to dst.
+func CenterStream(dst io.Writer, src io.Reader, opts ...Option) error {
+	o, err := newOptions(opts)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	return jpeg.Encode(out, dest, nil)
+	return centerStream(context.Background(), dst, src, o)
 }
 
-// CenterDir calls Center on every image in srcDir. n is the maximal number of goroutines.
-func CenterDir(ctx context.Context, srcDir, destDir string, n int) error {
+func centerStream(ctx context.Context, dst io.Writer, src io.Reader, o options) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	img, err := limitedDecode(ctx, data, o.decodes)
+	if err != nil {
+		return err
+	}
+
+	dest := o.transform(img)
+	defer putRGBA(dest)
+	if err := ctx.Err(); err != nil { // don't start encoding if we already gave up
+		return err
+	}
+	return encode(dst, dest, o)
+}
+
+// grayPalette is used to encode grayscale GIFs without losing shades.
+var grayPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i)}
+	}
+	return p
+}()
+
+// finish applies the final touches set in o to img, it may draw on img.
+func finish(img image.Image, o options) image.Image {
+	if o.watermark != nil {
+		if dest, ok := img.(draw.Image); ok {
+			o.watermark.draw(dest)
+		}
+	}
+	if o.grayscale {
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+	return img
+}
+
+// encode writes img, after finish, to w in the format set in o.
+func encode(w io.Writer, img image.Image, o options) error {
+	img = finish(img, o)
+
+	switch o.format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: o.quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		if o.grayscale { // default GIF palette has few grays
+			pm := image.NewPaletted(img.Bounds(), grayPalette)
+			draw.Draw(pm, pm.Bounds(), img, img.Bounds().Min, draw.Src)
+			img = pm
+		}
+		return gif.Encode(w, img, nil)
+	}
+	return fmt.Errorf("unsupported format: %q", o.format)
+}
+
+// Scale creates destFile which is srcFile resampled to w x h pixels.
+// Unlike Center, the whole image is kept.
+func Scale(srcFile, destFile string, w, h int, opts ...Option) error {
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("bad size: %dx%d", w, h)
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	src, err := load(srcFile)
+	if err != nil {
+		return err
+	}
+
+	dest := getRGBA(w, h)
+	defer putRGBA(dest)
+	scale(dest, src) // sets every pixel
+
+	return save(destFile, dest, o)
+}
+
+// Fit creates destFile which is exactly maxW x maxH pixels, with srcFile scaled to fit
+// inside it while keeping its aspect ratio. The image is centered and the rest is
+// filled with the background color (see WithBackground).
+func Fit(srcFile, destFile string, maxW, maxH int, opts ...Option) error {
+	if maxW <= 0 || maxH <= 0 {
+		return fmt.Errorf("bad size: %dx%d", maxW, maxH)
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	src, err := load(srcFile)
+	if err != nil {
+		return err
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	ratio := math.Min(float64(maxW)/float64(w), float64(maxH)/float64(h))
+	sw := max(1, int(math.Round(float64(w)*ratio)))
+	sh := max(1, int(math.Round(float64(h)*ratio)))
+
+	dest := image.NewRGBA(image.Rect(0, 0, maxW, maxH))
+	draw.Draw(dest, dest.Bounds(), image.NewUniform(o.background), image.Point{}, draw.Src)
+
+	x, y := (maxW-sw)/2, (maxH-sh)/2
+	scale(dest.SubImage(image.Rect(x, y, x+sw, y+sh)).(*image.RGBA), src)
+
+	return save(destFile, dest, o)
+}
+
+// Thumbnails creates a scaled copy of srcFile in destDir for every size in sizes.
+// The longest side of a thumbnail is size pixels and the aspect ratio is kept.
+// Outputs are named after srcFile with the size added, e.g. "cat_128.jpg".
+// srcFile is decoded once and the thumbnails are scaled concurrently.
+func Thumbnails(srcFile, destDir string, sizes []int, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	for _, size := range sizes {
+		if size <= 0 {
+			return fmt.Errorf("bad size: %d", size)
+		}
+	}
+
+	src, err := load(srcFile)
+	if err != nil {
+		return err
+	}
+
 	if err := os.Mkdir(destDir, 0750); err != nil && !errors.Is(err, fs.ErrExist) {
 		return err
 	}
 
-	matches, err := filepath.Glob(fmt.Sprintf("%s/*.jpg", srcDir))
+	name := filepath.Base(srcFile)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	errs := make([]error, len(sizes))
+	var wg sync.WaitGroup
+	wg.Add(len(sizes))
+	for i, size := range sizes {
+		go func() {
+			defer wg.Done()
+
+			ratio := float64(size) / float64(max(w, h))
+			tw := max(1, int(math.Round(float64(w)*ratio)))
+			th := max(1, int(math.Round(float64(h)*ratio)))
+			dest := image.NewRGBA(image.Rect(0, 0, tw, th))
+			scale(dest, src)
+
+			destFile := fmt.Sprintf("%s/%s_%d%s", destDir, name, size, extensions[o.format])
+			errs[i] = save(destFile, dest, o)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// save encodes img to destFile, see writeAtomic.
+func save(destFile string, img image.Image, o options) error {
+	return writeAtomic(destFile, func(out io.Writer) error {
+		return encode(out, img, o)
+	})
+}
+
+// writeAtomic calls write with a temporary file in the directory of destFile and renames
+// it to destFile once write succeeds. A crash or a failing write never leaves a partial
+// destFile, which incremental runs would take as done. The temporary file is removed
+// on error.
+func writeAtomic(destFile string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(destFile), "."+filepath.Base(destFile)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
 
-	for _, src := range matches {
-		dest := fmt.Sprintf("%s/%s", destDir, filepath.Base(src))
-		if err := Center(src, dest); err != nil {
-			return err
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil { // CreateTemp files are private
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destFile)
+}
+
+// CenterDir calls Center on every image in srcDir. n is the maximal number of goroutines.
+// A failing image doesn't stop the others, the returned error joins all failures.
+func CenterDir(ctx context.Context, srcDir, destDir string, n int, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = processDir(ctx, srcDir, []string{"*.jpg"}, destDir, n, o)
+	return err
+}
+
+// Report is the summary of a CenterDirReport run.
+type Report struct {
+	Processed int              // files done successfully
+	Failed    int              // files that failed
+	Skipped   int              // files skipped since their output is up to date
+	Failures  map[string]error // source file -> error
+	Duration  time.Duration
+	Planned   [][2]string // [src, dest] pairs, sorted by src, only in dry run
+	// BudgetExceeded is set when files were left out since the WithBudget time was up.
+	BudgetExceeded bool
+	PeakWorkers    int // maximal number of workers at once, n unless WithElastic
+}
+
+// CenterDirReport is CenterDir returning a Report of the run. The error is the same
+// as CenterDir's.
+func CenterDirReport(ctx context.Context, srcDir, destDir string, n int, opts ...Option) (Report, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return Report{}, err
+	}
+
+	return processDir(ctx, srcDir, []string{"*.jpg"}, destDir, n, o)
+}
+
+// inputPatterns are the glob patterns for images ConvertDir can decode.
+var inputPatterns = []string{"*.jpg", "*.jpeg", "*.png", "*.gif"}
+
+// ConvertDir converts every image (JPEG, PNG or GIF) in srcDir to format ("jpeg", "png"
+// or "gif"), see WithFormat. n is the maximal number of goroutines.
+// Extensions match regardless of case. Sources with the same output, like cat.jpg and
+// cat.png, are converted once, the others fail.
+func ConvertDir(ctx context.Context, srcDir, destDir string, format string, n int, opts ...Option) error {
+	o, err := newOptions(append(opts, WithFormat(format)))
+	if err != nil {
+		return err
+	}
+	o.transform = convert
+
+	_, err = processDir(ctx, srcDir, inputPatterns, destDir, n, o)
+	return err
+}
+
+// processDir runs the worker pool over the files in srcDir matching patterns, writing
+// the outputs to destDir.
+func processDir(ctx context.Context, srcDir string, patterns []string, destDir string, n int, o options) (Report, error) {
+	start := time.Now()
+	if n < 1 {
+		n = 1
+	}
+	if o.maxDecodes > 0 {
+		o.decodes = make(chan struct{}, o.maxDecodes)
+	}
+
+	matches, err := sources(srcDir, patterns, o.recursive)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if !o.dryRun {
+		if err := os.MkdirAll(destDir, 0750); err != nil {
+			return Report{}, err
 		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan [2]string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	var e *elastic
+	if o.idle > 0 {
+		e = &elastic{max: n, idle: o.idle}
+		e.spawn = func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				worker(ctx, jobs, results, o, e)
+			}()
+		}
+		e.grow()
+	} else {
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+				worker(ctx, jobs, results, o, nil)
+			}()
+		}
+	}
 
+	var budget <-chan time.Time
+	if o.budget > 0 {
+		timer := time.NewTimer(o.budget - time.Since(start))
+		defer timer.Stop()
+		budget = timer.C
 	}
 
-	return nil
+	prodErr := make(chan error, 1)
+	wg.Add(1) // producer might send skipped results as well
+	go func() {
+		defer wg.Done()
+		prodErr <- producer(ctx, jobs, results, matches, srcDir, destDir, budget, o, e)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var errs []error
+	report := Report{Failures: make(map[string]error)}
+	done := 0
+	for r := range results {
+		done++
+		switch {
+		case r.skipped:
+			o.logger.Debug("skipped", "src", r.src, "dest", r.dest)
+			report.Skipped++
+		case r.err != nil:
+			o.logger.Error("failed", "src", r.src, "error", r.err)
+			errs = append(errs, fmt.Errorf("%s: %w", r.src, r.err))
+			report.Failed++
+			report.Failures[r.src] = r.err
+		default:
+			o.logger.Debug("done", "src", r.src, "dest", r.dest)
+			report.Processed++
+		}
+		if o.dryRun && !r.skipped {
+			report.Planned = append(report.Planned, [2]string{r.src, r.dest})
+		}
+
+		if o.progress != nil {
+			p := Progress{Done: done, Total: len(matches), Current: r.src}
+			select {
+			case o.progress <- p:
+			default:
+			}
+		}
+	}
+
+	err = <-prodErr
+	report.BudgetExceeded = errors.Is(err, ErrBudgetExceeded)
+	errs = append(errs, err)
+	slices.SortFunc(report.Planned, func(a, b [2]string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	report.PeakWorkers = n
+	if e != nil {
+		report.PeakWorkers = int(e.peak.Load())
+	}
+	report.Duration = time.Since(start)
+	return report, errors.Join(errs...)
 }
 
 func main() {
@@ -110,8 +1001,9 @@ func main() {
 	srcDir := "input"
 	destDir := "output"
 
-	err := CenterDir(ctx, srcDir, destDir, n)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	err := CenterDir(ctx, srcDir, destDir, n, WithLogger(logger))
 
 	duration := time.Since(start)
-	log.Printf("info: finished in %v (err=%v)", duration, err)
+	logger.Info("finished", "duration", duration, "error", err)
 }
@@ -0,0 +1,983 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	white = color.RGBA{255, 255, 255, 255}
+)
+
+// quadrants returns a w x h image with red, green, blue and white quadrants, starting
+// top left and going clockwise except for white which is bottom right.
+func quadrants(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	fill := func(r image.Rectangle, c color.Color) {
+		draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	fill(image.Rect(0, 0, w/2, h/2), red)
+	fill(image.Rect(w/2, 0, w, h/2), green)
+	fill(image.Rect(0, h/2, w/2, h), blue)
+	fill(image.Rect(w/2, h/2, w, h), white)
+	return img
+}
+
+func writePNG(t testing.TB, path string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readImage(t testing.TB, path string) image.Image {
+	t.Helper()
+	img, err := load(path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return img
+}
+
+// near reports if c is within tolerance of want on every channel (8 bit).
+func near(c color.Color, want color.RGBA, tolerance int) bool {
+	r, g, b, _ := c.RGBA()
+	for _, d := range []int{int(r>>8) - int(want.R), int(g>>8) - int(want.G), int(b>>8) - int(want.B)} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScale(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "src.png"), quadrants(64, 64))
+
+	dest := filepath.Join(dir, "dest.png")
+	if err := Scale(filepath.Join(dir, "src.png"), dest, 16, 8, WithFormat("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readImage(t, dest)
+	if size := img.Bounds().Size(); size != (image.Point{16, 8}) {
+		t.Fatalf("size = %v, want 16x8", size)
+	}
+	corners := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, red},
+		{15, 0, green},
+		{0, 7, blue},
+		{15, 7, white},
+	}
+	for _, c := range corners {
+		if got := img.At(c.x, c.y); !near(got, c.want, 2) {
+			t.Errorf("(%d, %d) = %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+
+	if err := Scale(filepath.Join(dir, "src.png"), dest, 0, 8); err == nil {
+		t.Fatal("no error for a 0 width")
+	}
+}
+
+func writeJPEG(t testing.TB, path string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// srcDir returns a directory with n JPEG images named img00.jpg, img01.jpg...
+func srcDir(t testing.TB, n int) string {
+	t.Helper()
+	dir := t.TempDir()
+	img := quadrants(32, 32)
+	for i := range n {
+		writeJPEG(t, filepath.Join(dir, fmt.Sprintf("img%02d.jpg", i)), img)
+	}
+	return dir
+}
+
+// names returns the names of the files in dir, sorted.
+func names(t testing.TB, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestCenterDirProgress(t *testing.T) {
+	src := srcDir(t, 5)
+	destDir := filepath.Join(t.TempDir(), "out")
+	progress := make(chan Progress, 5)
+
+	if err := CenterDir(context.Background(), src, destDir, 2, WithProgress(progress)); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, destDir); len(got) != 5 {
+		t.Fatalf("outputs = %v", got)
+	}
+
+	close(progress)
+	var done []int
+	for p := range progress {
+		if p.Total != 5 {
+			t.Fatalf("progress total = %d, want 5", p.Total)
+		}
+		done = append(done, p.Done)
+	}
+	if !slices.Equal(done, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("progress done = %v", done)
+	}
+}
+
+func TestQuality(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.jpg")
+	writeJPEG(t, src, quadrants(256, 256))
+
+	sizes := make(map[int]int64)
+	for _, q := range []int{10, 95} {
+		dest := filepath.Join(dir, fmt.Sprintf("q%d.jpg", q))
+		if err := Center(src, dest, WithQuality(q)); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[q] = info.Size()
+	}
+	if sizes[10] >= sizes[95] {
+		t.Fatalf("quality 10 is %d bytes, quality 95 is %d", sizes[10], sizes[95])
+	}
+
+	if err := Center(src, filepath.Join(dir, "q101.jpg"), WithQuality(101)); err == nil {
+		t.Fatal("no error for quality 101")
+	}
+}
+
+// exifJPEG returns img encoded as a JPEG with an EXIF orientation.
+func exifJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// little endian TIFF with IFD0 at 8 holding a single orientation entry
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // padding and next IFD
+
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(app1)+2))
+	segment = append(segment, app1...)
+
+	data := buf.Bytes()
+	return slices.Concat(data[:2], segment, data[2:])
+}
+
+func TestOrientation(t *testing.T) {
+	for _, o := range []uint16{1, 3, 6, 8} {
+		data := exifJPEG(t, quadrants(16, 8), o)
+		if got := orientation(data); got != int(o) {
+			t.Fatalf("orientation = %d, want %d", got, o)
+		}
+	}
+	if got := orientation([]byte("not a jpeg")); got != 1 {
+		t.Fatalf("orientation of garbage = %d, want 1", got)
+	}
+
+	img, err := decode(exifJPEG(t, quadrants(16, 8), 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != (image.Point{8, 16}) {
+		t.Fatalf("size = %v, want 8x16", size)
+	}
+	// rotated 90 clockwise, the red top left quadrant is now top right
+	if !near(img.At(7, 0), red, 40) {
+		t.Fatalf("top right = %v, want red", img.At(7, 0))
+	}
+}
+
+func TestOrient(t *testing.T) {
+	src := quadrants(4, 2)
+	tests := []struct {
+		o    int
+		size image.Point
+		at   image.Point // where the red top left pixel goes
+	}{
+		{1, image.Point{4, 2}, image.Point{0, 0}},
+		{2, image.Point{4, 2}, image.Point{3, 0}},
+		{3, image.Point{4, 2}, image.Point{3, 1}},
+		{4, image.Point{4, 2}, image.Point{0, 1}},
+		{5, image.Point{2, 4}, image.Point{0, 0}},
+		{6, image.Point{2, 4}, image.Point{1, 0}},
+		{7, image.Point{2, 4}, image.Point{1, 3}},
+		{8, image.Point{2, 4}, image.Point{0, 3}},
+	}
+
+	for _, tc := range tests {
+		img := orient(src, tc.o)
+		if size := img.Bounds().Size(); size != tc.size {
+			t.Errorf("%d: size = %v, want %v", tc.o, size, tc.size)
+		}
+		if !near(img.At(tc.at.X, tc.at.Y), red, 0) {
+			t.Errorf("%d: %v = %v, want red", tc.o, tc.at, img.At(tc.at.X, tc.at.Y))
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.png")
+	writePNG(t, src, quadrants(8, 8))
+
+	for _, format := range []string{"jpeg", "png", "gif"} {
+		dest := filepath.Join(dir, "dest."+format)
+		if err := Center(src, dest, WithFormat(format)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || got != format {
+			t.Errorf("%s: encoded as %q, %v", format, got, err)
+		}
+	}
+
+	if err := Center(src, filepath.Join(dir, "dest.bmp"), WithFormat("bmp")); err == nil {
+		t.Fatal("no error for an unsupported format")
+	}
+}
+
+func uniform(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestFit(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "src.png"), uniform(100, 50, red))
+
+	dest := filepath.Join(dir, "dest.png")
+	err := Fit(filepath.Join(dir, "src.png"), dest, 40, 40, WithFormat("png"), WithBackground(blue))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := readImage(t, dest)
+	if size := img.Bounds().Size(); size != (image.Point{40, 40}) {
+		t.Fatalf("size = %v, want 40x40", size)
+	}
+	// 100x50 fits as 40x20, centered with 10 rows of background above and below
+	if !near(img.At(20, 0), blue, 0) || !near(img.At(20, 39), blue, 0) {
+		t.Fatal("no background above and below")
+	}
+	if !near(img.At(0, 20), red, 2) || !near(img.At(39, 20), red, 2) {
+		t.Fatal("image doesn't span the width")
+	}
+}
+
+func TestCenterDirPanic(t *testing.T) {
+	src := srcDir(t, 2)
+	bad := filepath.Join(src, "bad.jpg")
+	writeJPEG(t, bad, quadrants(16, 16))
+
+	o, err := newOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.transform = func(img image.Image) *image.RGBA {
+		if img.Bounds().Dx() == 16 {
+			panic("malformed image")
+		}
+		return crop(img)
+	}
+
+	report, err := processDir(context.Background(), src, []string{"*.jpg"}, t.TempDir(), 2, o)
+	if err == nil {
+		t.Fatal("no error for a panic")
+	}
+	if report.Processed != 2 || report.Failed != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	msg := report.Failures[bad].Error()
+	if !strings.HasPrefix(msg, "panic: malformed image\n") || !strings.Contains(msg, "goroutine ") {
+		t.Fatalf("error = %q, want the panic and its stack", msg)
+	}
+}
+
+func TestCenter(t *testing.T) {
+	dir := t.TempDir()
+	src := uniform(8, 8, color.Black)
+	draw.Draw(src, image.Rect(2, 2, 6, 6), image.NewUniform(white), image.Point{}, draw.Src)
+	writePNG(t, filepath.Join(dir, "src.png"), src)
+
+	dest := filepath.Join(dir, "dest.png")
+	if err := Center(filepath.Join(dir, "src.png"), dest, WithFormat("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readImage(t, dest)
+	if size := img.Bounds().Size(); size != (image.Point{4, 4}) {
+		t.Fatalf("size = %v, want 4x4", size)
+	}
+	for y := range 4 {
+		for x := range 4 {
+			if !near(img.At(x, y), white, 0) {
+				t.Fatalf("(%d, %d) = %v, want white", x, y, img.At(x, y))
+			}
+		}
+	}
+}
+
+func TestCenterStream(t *testing.T) {
+	var src, dst bytes.Buffer
+	if err := png.Encode(&src, quadrants(8, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CenterStream(&dst, &src, WithFormat("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(img.At(0, 0), red, 0) || !near(img.At(3, 3), white, 0) {
+		t.Fatalf("corners = %v, %v", img.At(0, 0), img.At(3, 3))
+	}
+}
+
+func TestCenterDirDryRun(t *testing.T) {
+	src := srcDir(t, 3)
+	destDir := filepath.Join(t.TempDir(), "out")
+
+	if err := CenterDir(context.Background(), src, destDir, 2, WithDryRun()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(destDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("dry run created destDir")
+	}
+}
+
+func TestCenterDirCancel(t *testing.T) {
+	src := srcDir(t, 30)
+	destDir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := make(chan Progress, 30)
+	go func() {
+		<-progress
+		cancel()
+	}()
+
+	err := CenterDir(ctx, src, destDir, 2, WithProgress(progress))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	outputs := names(t, destDir)
+	if len(outputs) == 30 {
+		t.Fatal("cancel didn't stop the run")
+	}
+	for _, name := range outputs {
+		if strings.HasPrefix(name, ".") {
+			t.Fatalf("temporary file %s left", name)
+		}
+		readImage(t, filepath.Join(destDir, name)) // no partial file
+	}
+}
+
+func TestConvertDir(t *testing.T) {
+	src := t.TempDir()
+	writeJPEG(t, filepath.Join(src, "a.JPG"), quadrants(8, 8))
+	writePNG(t, filepath.Join(src, "b.png"), quadrants(8, 8))
+	destDir := t.TempDir()
+
+	if err := ConvertDir(context.Background(), src, destDir, "png", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(t, destDir), []string{"a.png", "b.png"}; !slices.Equal(got, want) {
+		t.Fatalf("outputs = %v, want %v", got, want)
+	}
+	// converted, not cropped
+	img := readImage(t, filepath.Join(destDir, "b.png"))
+	if size := img.Bounds().Size(); size != (image.Point{8, 8}) {
+		t.Fatalf("size = %v, want 8x8", size)
+	}
+}
+
+func TestConvertDirCollision(t *testing.T) {
+	src := t.TempDir()
+	writeJPEG(t, filepath.Join(src, "cat.jpg"), quadrants(8, 8))
+	writePNG(t, filepath.Join(src, "cat.png"), quadrants(8, 8))
+	destDir := t.TempDir()
+
+	err := ConvertDir(context.Background(), src, destDir, "gif", 2)
+	if err == nil || !strings.Contains(err.Error(), "same output") {
+		t.Fatalf("err = %v, want a collision error", err)
+	}
+	if got := names(t, destDir); !slices.Equal(got, []string{"cat.gif"}) {
+		t.Fatalf("outputs = %v, want [cat.gif]", got)
+	}
+}
+
+func TestCenterDirReport(t *testing.T) {
+	src := srcDir(t, 5)
+
+	report, err := CenterDirReport(context.Background(), src, t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 5 || report.Failed != 0 || report.Skipped != 0 || len(report.Failures) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Duration <= 0 {
+		t.Fatalf("duration = %v", report.Duration)
+	}
+}
+
+func TestCenterDirFailures(t *testing.T) {
+	src := srcDir(t, 2)
+	bad := filepath.Join(src, "bad.jpg")
+	if err := os.WriteFile(bad, []byte("not a jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CenterDirReport(context.Background(), src, t.TempDir(), 2)
+	if err == nil || !strings.Contains(err.Error(), "bad.jpg") {
+		t.Fatalf("err = %v, want a bad.jpg error", err)
+	}
+	if report.Processed != 2 || report.Failed != 1 || report.Failures[bad] == nil {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestCenterDirPlanned(t *testing.T) {
+	src := srcDir(t, 3)
+	destDir := filepath.Join(t.TempDir(), "out")
+
+	report, err := CenterDirReport(context.Background(), src, destDir, 2, WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want [][2]string
+	for _, name := range []string{"img00.jpg", "img01.jpg", "img02.jpg"} {
+		want = append(want, [2]string{filepath.Join(src, name), filepath.Join(destDir, name)})
+	}
+	if !slices.Equal(report.Planned, want) {
+		t.Fatalf("planned = %v, want %v", report.Planned, want)
+	}
+
+	if report, _ := CenterDirReport(context.Background(), src, destDir, 2); report.Planned != nil {
+		t.Fatalf("planned without dry run = %v", report.Planned)
+	}
+}
+
+func TestCenterDirIncremental(t *testing.T) {
+	src := srcDir(t, 3)
+	destDir := t.TempDir()
+	ctx := context.Background()
+
+	if _, err := CenterDirReport(ctx, src, destDir, 2, WithIncremental()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := CenterDirReport(ctx, src, destDir, 2, WithIncremental())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 3 || report.Processed != 0 {
+		t.Fatalf("second run report = %+v", report)
+	}
+
+	// a newer source is done again
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "img01.jpg"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	report, err = CenterDirReport(ctx, src, destDir, 2, WithIncremental())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 2 || report.Processed != 1 {
+		t.Fatalf("third run report = %+v", report)
+	}
+}
+
+func TestGrayscale(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "src.png"), quadrants(8, 8))
+
+	dest := filepath.Join(dir, "dest.png")
+	if err := Center(filepath.Join(dir, "src.png"), dest, WithFormat("png"), WithGrayscale()); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readImage(t, dest)
+	for y := range 4 {
+		for x := range 4 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			if r != g || g != b {
+				t.Fatalf("(%d, %d) = %v, not gray", x, y, img.At(x, y))
+			}
+		}
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	dir := t.TempDir()
+	writeJPEG(t, filepath.Join(dir, "cat.jpg"), quadrants(200, 100))
+
+	destDir := filepath.Join(dir, "thumbs")
+	if err := Thumbnails(filepath.Join(dir, "cat.jpg"), destDir, []int{64, 32}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		size image.Point
+	}{
+		{"cat_64.jpg", image.Point{64, 32}},
+		{"cat_32.jpg", image.Point{32, 16}},
+	} {
+		img := readImage(t, filepath.Join(destDir, tc.name))
+		if size := img.Bounds().Size(); size != tc.size {
+			t.Errorf("%s: size = %v, want %v", tc.name, size, tc.size)
+		}
+	}
+
+	if err := Thumbnails(filepath.Join(dir, "cat.jpg"), destDir, []int{0}); err == nil {
+		t.Fatal("no error for size 0")
+	}
+}
+
+func TestCenterDirRate(t *testing.T) {
+	src := srcDir(t, 5)
+
+	start := time.Now()
+	if err := CenterDir(context.Background(), src, t.TempDir(), 5, WithRate(50)); err != nil {
+		t.Fatal(err)
+	}
+	// a file every 20ms
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("took %v, want at least 80ms", d)
+	}
+
+	if err := CenterDir(context.Background(), src, t.TempDir(), 5, WithRate(int(2*time.Second))); err != nil {
+		t.Fatalf("rate above the ticker resolution: %v", err)
+	}
+	if err := CenterDir(context.Background(), src, t.TempDir(), 5, WithRate(-1)); err == nil {
+		t.Fatal("no error for a negative rate")
+	}
+}
+
+func TestCenterDirMaxDecodes(t *testing.T) {
+	var active, peak atomic.Int64
+	decodeImage = func(data []byte) (image.Image, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		return decode(data)
+	}
+	t.Cleanup(func() { decodeImage = decode })
+	src := srcDir(t, 12)
+
+	if err := CenterDir(context.Background(), src, t.TempDir(), 6, WithMaxDecodes(2)); err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Fatalf("peak of %d concurrent decodes, want at most 2", p)
+	}
+
+	// without the limit, every worker may decode
+	peak.Store(0)
+	if err := CenterDir(context.Background(), src, t.TempDir(), 6); err != nil {
+		t.Fatal(err)
+	}
+	if p := peak.Load(); p <= 2 {
+		t.Fatalf("peak of %d concurrent decodes with 6 workers and no limit", p)
+	}
+
+	if _, err := newOptions([]Option{WithMaxDecodes(-1)}); err == nil {
+		t.Fatal("no error for a negative limit")
+	}
+}
+
+func TestCenterDirRecursive(t *testing.T) {
+	src := srcDir(t, 1)
+	if err := os.Mkdir(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeJPEG(t, filepath.Join(src, "sub", "nested.jpg"), quadrants(8, 8))
+	destDir := t.TempDir()
+
+	if err := CenterDir(context.Background(), src, destDir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "sub")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("sub directory processed without WithRecursive")
+	}
+
+	if err := CenterDir(context.Background(), src, destDir, 2, WithRecursive()); err != nil {
+		t.Fatal(err)
+	}
+	readImage(t, filepath.Join(destDir, "sub", "nested.jpg"))
+}
+
+func TestCropPooled(t *testing.T) {
+	src := quadrants(64, 48)
+	want := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	draw.Draw(want, want.Bounds(), src, image.Point{16, 12}, draw.Src)
+
+	for range 4 {
+		// crop must overwrite every pixel of a reused buffer
+		dirty := getRGBA(32, 24)
+		for i := range dirty.Pix {
+			dirty.Pix[i] = 0xAB
+		}
+		putRGBA(dirty)
+
+		got := crop(src)
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatal("pooled crop differs from a fresh one")
+		}
+		putRGBA(got)
+	}
+}
+
+func BenchmarkCenter(b *testing.B) {
+	src := quadrants(1024, 768)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			putRGBA(crop(src))
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			x, y := src.Bounds().Max.X, src.Bounds().Max.Y
+			dest := image.NewRGBA(image.Rect(0, 0, x/2, y/2))
+			draw.Draw(dest, dest.Bounds(), src, image.Point{x / 4, y / 4}, draw.Src)
+		}
+	})
+}
+
+func TestWatermark(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "src.png"), uniform(8, 8, red))
+
+	dest := filepath.Join(dir, "dest.png")
+	mark := uniform(2, 2, blue)
+	if err := Center(filepath.Join(dir, "src.png"), dest, WithFormat("png"), WithWatermark(mark, TopRight, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readImage(t, dest)
+	if !near(img.At(3, 0), blue, 0) || !near(img.At(2, 1), blue, 0) {
+		t.Fatal("no watermark top right")
+	}
+	if !near(img.At(0, 0), red, 0) || !near(img.At(3, 3), red, 0) {
+		t.Fatal("watermark outside the top right corner")
+	}
+
+	for _, opt := range []Option{WithWatermark(nil, TopLeft, 1), WithWatermark(mark, TopLeft, 2)} {
+		if _, err := newOptions([]Option{opt}); err == nil {
+			t.Fatal("no error for a nil watermark or an opacity above 1")
+		}
+	}
+}
+
+// recordHandler is a slog.Handler keeping the records it handles.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	src := srcDir(t, 2)
+	bad := filepath.Join(src, "bad.jpg")
+	if err := os.WriteFile(bad, []byte("not a jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+	ctx := context.Background()
+
+	// each file gets a message with its source, at a level matching its outcome
+	for _, want := range []map[string]string{
+		{"img00.jpg": "DEBUG done", "img01.jpg": "DEBUG done", "bad.jpg": "ERROR failed"},
+		{"img00.jpg": "DEBUG skipped", "img01.jpg": "DEBUG skipped", "bad.jpg": "ERROR failed"},
+	} {
+		h := &recordHandler{}
+		CenterDir(ctx, src, destDir, 2, WithIncremental(), WithLogger(slog.New(h)))
+
+		got := make(map[string]string)
+		for _, r := range h.records {
+			r.Attrs(func(a slog.Attr) bool {
+				if a.Key == "src" {
+					got[filepath.Base(a.Value.String())] = r.Level.String() + " " + r.Message
+				}
+				return true
+			})
+		}
+		if !maps.Equal(got, want) {
+			t.Fatalf("logged %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a := quadrants(8, 8)
+	if score, err := Compare(a, a); err != nil || score != 1 {
+		t.Fatalf("identical: %v, %v", score, err)
+	}
+
+	score, err := Compare(uniform(8, 8, color.Black), uniform(8, 8, white))
+	if err != nil || score > 0.5 {
+		t.Fatalf("black and white: %v, %v", score, err)
+	}
+
+	if _, err := Compare(a, quadrants(4, 4)); err == nil {
+		t.Fatal("no error for different sizes")
+	}
+}
+
+func TestCenterDirPreserveModTime(t *testing.T) {
+	src := srcDir(t, 1)
+	mtime := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "img00.jpg"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+
+	if err := CenterDir(context.Background(), src, destDir, 1, WithPreserveModTime()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(destDir, "img00.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mod time = %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "out.jpg")
+	errFull := errors.New("disk full")
+	failing := func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errFull
+	}
+
+	if err := writeAtomic(dest, failing); !errors.Is(err, errFull) {
+		t.Fatalf("err = %v, want %v", err, errFull)
+	}
+	if got := names(t, dir); len(got) != 0 {
+		t.Fatalf("files left: %v", got)
+	}
+
+	// a failed write keeps the previous file
+	if err := os.WriteFile(dest, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAtomic(dest, failing); !errors.Is(err, errFull) {
+		t.Fatalf("err = %v, want %v", err, errFull)
+	}
+	if got := names(t, dir); !slices.Equal(got, []string{"out.jpg"}) {
+		t.Fatalf("files = %v, want [out.jpg]", got)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "old" {
+		t.Fatalf("out.jpg = %q, want the previous content", data)
+	}
+}
+
+func TestCenterDirBudget(t *testing.T) {
+	src := srcDir(t, 20)
+
+	report, err := CenterDirReport(context.Background(), src, t.TempDir(), 2, WithRate(100), WithBudget(50*time.Millisecond))
+	if !errors.Is(err, ErrBudgetExceeded) || !report.BudgetExceeded {
+		t.Fatalf("err = %v, report = %+v", err, report)
+	}
+	if report.Processed == 0 || report.Processed >= 20 {
+		t.Fatalf("processed %d files, want some but not all", report.Processed)
+	}
+
+	if _, err := newOptions([]Option{WithBudget(-time.Second)}); err == nil {
+		t.Fatal("no error for a negative budget")
+	}
+}
+
+// slowCrop returns a crop transform taking d, and the peak number of concurrent calls.
+func slowCrop(d time.Duration) (func(image.Image) *image.RGBA, *atomic.Int64) {
+	var active, peak atomic.Int64
+	return func(img image.Image) *image.RGBA {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(d)
+		return crop(img)
+	}, &peak
+}
+
+func TestCenterDirElastic(t *testing.T) {
+	src := srcDir(t, 20)
+
+	report, err := CenterDirReport(context.Background(), src, t.TempDir(), 3)
+	if err != nil || report.PeakWorkers != 3 {
+		t.Fatalf("fixed pool: peak workers = %d, %v", report.PeakWorkers, err)
+	}
+
+	o, err := newOptions([]Option{WithElastic(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peak *atomic.Int64
+	o.transform, peak = slowCrop(10 * time.Millisecond)
+	report, err = processDir(context.Background(), src, []string{"*.jpg"}, t.TempDir(), 4, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 20 {
+		t.Fatalf("processed %d files, want 20", report.Processed)
+	}
+	if report.PeakWorkers < 2 || report.PeakWorkers > 4 {
+		t.Fatalf("peak workers = %d, want 2-4", report.PeakWorkers)
+	}
+	if p := peak.Load(); p < 2 || p > 4 {
+		t.Fatalf("peak of %d concurrent files, want 2-4", p)
+	}
+
+	if _, err := newOptions([]Option{WithElastic(-time.Second)}); err == nil {
+		t.Fatal("no error for a negative idle timeout")
+	}
+}
+
+func TestElasticShrink(t *testing.T) {
+	src := srcDir(t, 8)
+	destDir := t.TempDir()
+	o, err := newOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peak *atomic.Int64
+	o.transform, peak = slowCrop(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan [2]string)
+	results := make(chan result, 8)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(jobs)
+
+	e := &elastic{max: 4, idle: 20 * time.Millisecond}
+	e.spawn = func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(ctx, jobs, results, o, e)
+		}()
+	}
+	e.grow()
+
+	// bursts of slow jobs, sent like the producer does, with idle time in between
+	for burst := range 2 {
+		for i := range 4 {
+			name := fmt.Sprintf("img%02d.jpg", burst*4+i)
+			job := [2]string{filepath.Join(src, name), filepath.Join(destDir, name)}
+			select {
+			case jobs <- job:
+				continue
+			default:
+				e.grow()
+			}
+			jobs <- job
+		}
+		for range 4 {
+			if r := <-results; r.err != nil {
+				t.Fatal(r.err)
+			}
+		}
+		if p := e.peak.Load(); p < 2 || p > 4 {
+			t.Fatalf("burst %d: peak workers = %d, want 2-4", burst, p)
+		}
+		if p := peak.Load(); p < 2 || p > 4 {
+			t.Fatalf("burst %d: peak of %d concurrent jobs, want 2-4", burst, p)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for e.workers.Load() > 1 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := e.workers.Load(); n != 1 {
+			t.Fatalf("burst %d: %d workers left after idling, want 1", burst, n)
+		}
+		e.peak.Store(1)
+		peak.Store(0)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// catmullRom is the Catmull-Rom cubic kernel, it has a support of 2 pixels.
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+// contrib holds the source pixels (starting at start) and their weights used to
+// compute a single destination pixel along one axis.
+type contrib struct {
+	start   int
+	weights []float64
+}
+
+// contribs computes the contributions for resampling srcN pixels into dstN pixels.
+// When downscaling the kernel is stretched so every source pixel is accounted for.
+func contribs(dstN, srcN int) []contrib {
+	ratio := float64(srcN) / float64(dstN)
+	support := 2.0
+	if ratio > 1 {
+		support *= ratio
+	}
+
+	out := make([]contrib, dstN)
+	for i := range out {
+		center := (float64(i)+0.5)*ratio - 0.5
+		lo := int(math.Ceil(center - support))
+		hi := int(math.Floor(center + support))
+
+		weights := make([]float64, 0, hi-lo+1)
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			x := float64(j) - center
+			if ratio > 1 {
+				x /= ratio
+			}
+			w := catmullRom(x)
+			weights = append(weights, w)
+			sum += w
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		out[i] = contrib{start: lo, weights: weights}
+	}
+	return out
+}
+
+// clampInt returns v limited to [lo, hi].
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// clamp8 converts a 16 bit color value to 8 bit, clamping overshoot from the kernel.
+func clamp8(v float64) uint8 {
+	v = math.Round(v / 257)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// scale resamples all of src into dst using a separable Catmull-Rom filter.
+func scale(dst *image.RGBA, src image.Image) {
+	sb, db := src.Bounds(), dst.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dw, dh := db.Dx(), db.Dy()
+	if sw == 0 || sh == 0 || dw == 0 || dh == 0 {
+		return
+	}
+
+	// Horizontal pass: sh rows of dw pixels, 4 (premultiplied) channels each.
+	cx := contribs(dw, sw)
+	tmp := make([]float64, sh*dw*4)
+	for y := 0; y < sh; y++ {
+		for x, c := range cx {
+			var r, g, b, a float64
+			for i, w := range c.weights {
+				sx := clampInt(c.start+i, 0, sw-1)
+				pr, pg, pb, pa := src.At(sb.Min.X+sx, sb.Min.Y+y).RGBA()
+				r += w * float64(pr)
+				g += w * float64(pg)
+				b += w * float64(pb)
+				a += w * float64(pa)
+			}
+			off := (y*dw + x) * 4
+			tmp[off], tmp[off+1], tmp[off+2], tmp[off+3] = r, g, b, a
+		}
+	}
+
+	// Vertical pass: from tmp into dst.
+	cy := contribs(dh, sh)
+	for y, c := range cy {
+		for x := 0; x < dw; x++ {
+			var r, g, b, a float64
+			for i, w := range c.weights {
+				sy := clampInt(c.start+i, 0, sh-1)
+				off := (sy*dw + x) * 4
+				r += w * tmp[off]
+				g += w * tmp[off+1]
+				b += w * tmp[off+2]
+				a += w * tmp[off+3]
+			}
+			off := dst.PixOffset(db.Min.X+x, db.Min.Y+y)
+			dst.Pix[off] = clamp8(r)
+			dst.Pix[off+1] = clamp8(g)
+			dst.Pix[off+2] = clamp8(b)
+			dst.Pix[off+3] = clamp8(a)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "sync"
+
+// Group manages named caches, each with its own configuration, that are reported and
+// cleared together. It's safe for concurrent use.
+type Group struct {
+	opts []Option
+
+	mu     sync.Mutex
+	caches map[string]*Cache
+}
+
+// NewGroup returns an empty group, opts are the defaults for every cache in the group.
+func NewGroup(opts ...Option) *Group {
+	return &Group{
+		opts:   opts,
+		caches: make(map[string]*Cache),
+	}
+}
+
+// Cache returns the cache called name, creating it if needed with the group defaults
+// followed by opts. opts are ignored if the cache already exists.
+func (g *Group) Cache(name string, opts ...Option) (*Cache, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if c, ok := g.caches[name]; ok {
+		return c, nil
+	}
+
+	c, err := New(append(g.opts[:len(g.opts):len(g.opts)], opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	g.caches[name] = c
+	return c, nil
+}
+
+// Stats returns the sum of the stats of all caches in the group.
+func (g *Group) Stats() Stats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var total Stats
+	for _, c := range g.caches {
+		s := c.Stats()
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.Evictions += s.Evictions
+		total.Expirations += s.Expirations
+	}
+	return total
+}
+
+// Clear clears all caches in the group.
+func (g *Group) Clear() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, c := range g.caches {
+		c.Clear()
+	}
+}
+
+// Close closes all caches in the group and removes them from it.
+func (g *Group) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for name, c := range g.caches {
+		c.Close()
+		delete(g.caches, name)
+	}
+}
@@ -3,44 +3,281 @@ package main
 import (
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Entry struct {
 	value      any
-	expiration time.Time
+	expiration time.Time // zero means never
+	size       int64
+	uses       int64 // number of Get hits and updates, for LFU
+}
+
+// expired reports if the entry expired at now.
+func (e Entry) expired(now time.Time) bool {
+	return !e.expiration.IsZero() && now.After(e.expiration)
+}
+
+// Policy selects which entry is evicted when the cache is full.
+type Policy int
+
+const (
+	FIFO Policy = iota // evict the least recently added entry (the default)
+	LRU                // evict the least recently used entry
+	LFU                // evict the least frequently used entry, the oldest on ties
+)
+
+// NoExpiration is returned by TTL for entries that never expire.
+const NoExpiration time.Duration = -1
+
+// Sizer returns the size in bytes of a cached value.
+type Sizer func(value any) int64
+
+// defaultSizer knows the size of []byte and string, other values count as 0.
+func defaultSizer(value any) int64 {
+	switch v := value.(type) {
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
+	}
+	return 0
 }
 
 type Cache struct {
-	size int
-	ttl  time.Duration
+	size     int
+	ttl      time.Duration
+	maxBytes int64
+	sizer    Sizer
+	jitter   float64
+	cleanup  time.Duration
+	onEvict  func(key string, value any)
+	policy   Policy
+	// persistPath is where the entries are loaded from and saved to, "" means nowhere
+	persistPath string
+
+	done       chan struct{} // closed by Close to stop the janitor and the writer
+	closeOnce  sync.Once
+	writerOnce sync.Once     // starts writer on the first SetAsync, or marks it done on Close
+	writes     chan write    // SetAsync queue, drained by writer, nil until the first SetAsync
+	writerDone chan struct{} // closed when writer exits
+
+	hits, misses, evictions, expirations atomic.Int64
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight // GetOrCompute calls in progress
 
 	mu sync.Mutex
 	m  map[string]Entry
-	// maintain insertion order to evict oldest when full
-	keys []string
+	// keys in eviction order: insertion order, with LRU used entries move to the end
+	keys  []string
+	bytes int64
 }
 
-func New(size int, ttl time.Duration) (*Cache, error) {
-	if size <= 0 {
+// asyncQueueSize is the number of SetAsync writes that can be pending before SetAsync blocks.
+const asyncQueueSize = 1024
+
+// write is a pending SetAsync.
+type write struct {
+	key   string
+	value any
+}
+
+// Stats are cache usage counters.
+type Stats struct {
+	Hits        int64 // Get found the key
+	Misses      int64 // Get didn't find the key, or it expired
+	Evictions   int64 // entries removed to make room
+	Expirations int64 // entries removed since they expired, by Get or the cleanup
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithSize sets the maximal number of entries, required.
+func WithSize(size int) Option {
+	return func(c *Cache) {
+		c.size = size
+	}
+}
+
+// WithTTL sets how long entries live, 0 (the default) means entries never expire and
+// leave the cache only when evicted, deleted or cleared.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.ttl = ttl
+	}
+}
+
+// WithCleanupInterval starts a goroutine that removes expired entries every interval,
+// until Close is called. By default expired entries are removed only when accessed.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.cleanup = interval
+	}
+}
+
+// WithOnEvict sets a function called when an entry is evicted or expires.
+// fn is called with the cache locked and must not call any Cache method.
+func WithOnEvict(fn func(key string, value any)) Option {
+	return func(c *Cache) {
+		c.onEvict = fn
+	}
+}
+
+// WithMaxBytes limits the total size of cached values to n bytes.
+// The size of values is computed by the cache Sizer.
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// WithSizer sets the function used to compute value sizes for WithMaxBytes.
+func WithSizer(sizer Sizer) Option {
+	return func(c *Cache) {
+		c.sizer = sizer
+	}
+}
+
+// WithPolicy sets the eviction policy, default is FIFO.
+func WithPolicy(p Policy) Option {
+	return func(c *Cache) {
+		c.policy = p
+	}
+}
+
+// WithTTLJitter spreads expirations: every entry lives for ttl ± a random duration of
+// up to ttl*fraction. fraction must be in [0, 1) so the TTL is always positive.
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Cache) {
+		c.jitter = fraction
+	}
+}
+
+// New returns a cache configured by opts, WithSize is required.
+// If WithMaxBytes is used as well, both size limits apply.
+func New(opts ...Option) (*Cache, error) {
+	c := &Cache{
+		sizer:      defaultSizer,
+		m:          make(map[string]Entry),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.size <= 0 {
 		return nil, fmt.Errorf("size must be positive")
 	}
-	if ttl <= 0 {
-		return nil, fmt.Errorf("ttl must be positive")
+	if c.ttl < 0 {
+		return nil, fmt.Errorf("ttl must not be negative")
+	}
+	if c.cleanup < 0 {
+		return nil, fmt.Errorf("cleanup interval must not be negative")
+	}
+	if c.maxBytes < 0 {
+		return nil, fmt.Errorf("max bytes must not be negative")
+	}
+	if c.sizer == nil {
+		return nil, fmt.Errorf("nil sizer")
+	}
+	if c.jitter < 0 || c.jitter >= 1 {
+		return nil, fmt.Errorf("ttl jitter must be in [0, 1)")
+	}
+	if c.policy < FIFO || c.policy > LFU {
+		return nil, fmt.Errorf("unknown policy: %d", c.policy)
 	}
-	return &Cache{
-		size: size,
-		ttl:  ttl,
-		m:    make(map[string]Entry),
-	}, nil
+
+	if c.persistPath != "" {
+		c.load()
+	}
+	if c.cleanup > 0 {
+		go c.janitor(c.cleanup)
+	}
+	return c, nil
 }
 
-func (c *Cache) Close() {
+// writer applies SetAsync writes until the cache is closed, then applies the pending ones.
+func (c *Cache) writer() {
+	defer close(c.writerDone)
+
+	for {
+		select {
+		case w := <-c.writes:
+			c.Set(w.key, w.value)
+		case <-c.done:
+			for {
+				select {
+				case w := <-c.writes:
+					c.Set(w.key, w.value)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// janitor removes expired entries every interval until the cache is closed.
+func (c *Cache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.deleteExpired()
+		}
+	}
+}
+
+// deleteExpired removes all expired entries.
+func (c *Cache) deleteExpired() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.m = nil
-	c.keys = nil
+
+	now := time.Now()
+	live := c.keys[:0]
+	for _, k := range c.keys {
+		entry := c.m[k]
+		if entry.expired(now) {
+			delete(c.m, k)
+			c.bytes -= entry.size
+			c.evicted(k, entry, true)
+			continue
+		}
+		live = append(live, k)
+	}
+	c.keys = live
+}
+
+// Close flushes pending SetAsync writes, stops background goroutines, saves the entries
+// WithPersistPath and releases them.
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.writerOnce.Do(func() { close(c.writerDone) }) // SetAsync was never called
+		<-c.writerDone
+
+		if c.persistPath != "" {
+			if err := c.SaveToFile(c.persistPath); err != nil {
+				log.Printf("warn: %q: can't save cache - %s", c.persistPath, err)
+			}
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.m = nil
+		c.keys = nil
+		c.bytes = 0
+	})
 }
 
 func (c *Cache) Get(key string) (any, bool) {
@@ -49,43 +286,309 @@ func (c *Cache) Get(key string) (any, bool) {
 
 	entry, found := c.m[key]
 	if !found {
+		c.misses.Add(1)
 		return nil, false
 	}
 
 	// expired?
-	if time.Since(entry.expiration) > 0 {
+	if entry.expired(time.Now()) {
 		delete(c.m, key)
 		c.removeKey(key)
+		c.bytes -= entry.size
+		c.evicted(key, entry, true)
+		c.misses.Add(1)
 		return nil, false
 	}
+	c.hits.Add(1)
+	c.used(key, entry)
 	return entry.value, true
 }
 
+// used records an access to key for the eviction policy, c.mu must be held.
+func (c *Cache) used(key string, entry Entry) {
+	switch c.policy {
+	case LRU:
+		c.removeKey(key)
+		c.keys = append(c.keys, key)
+	case LFU:
+		entry.uses++
+		c.m[key] = entry
+	}
+}
+
+// Stats returns the usage counters of the cache.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+	}
+}
+
+// Has reports if key is in the cache and not expired. Unlike Get, it doesn't remove
+// expired entries.
+func (c *Cache) Has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.m[key]
+	return found && !entry.expired(time.Now())
+}
+
 func (c *Cache) Set(key string, value any) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// if exists, update value and expiration, no need to reorder
-	if _, found := c.m[key]; found {
-		c.m[key] = Entry{
+	c.set(key, value)
+}
+
+// SetAsync is like Set but returns without waiting for the cache lock, the write is queued
+// and applied in the background. It blocks only when the queue is full.
+// The first call starts the background writer, which runs until Close.
+// Writes queued after Close are dropped.
+func (c *Cache) SetAsync(key string, value any) {
+	c.writerOnce.Do(func() {
+		c.writes = make(chan write, asyncQueueSize)
+		go c.writer()
+	})
+
+	select {
+	case c.writes <- write{key, value}:
+	case <-c.done:
+	}
+}
+
+// flight is a GetOrCompute computation in progress.
+type flight struct {
+	done  chan struct{} // closed once value and err are set
+	value any
+	err   error
+}
+
+// GetOrCompute returns the value of key, calling fn to compute and set it if key is not
+// in the cache. Concurrent calls for the same missing key wait for a single fn call and
+// share its result. Errors are returned but not cached. If fn panics, the panic is
+// propagated to the caller that called fn and the waiting callers get an error.
+// fn is called without the cache locked, so it may use the cache.
+func (c *Cache) GetOrCompute(key string, fn func() (any, error)) (any, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+
+	c.flightsMu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.flightsMu.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	if c.Has(key) { // a flight finished since Get
+		c.flightsMu.Unlock()
+		return c.GetOrCompute(key, fn)
+	}
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.flightsMu.Unlock()
+
+	defer func() {
+		// if fn panics, waiters get an error and the panic goes on in this caller
+		v := recover()
+		if v != nil {
+			f.value, f.err = nil, fmt.Errorf("%q: compute panicked: %v", key, v)
+		}
+
+		c.flightsMu.Lock()
+		delete(c.flights, key)
+		c.flightsMu.Unlock()
+		close(f.done)
+
+		if v != nil {
+			panic(v)
+		}
+	}()
+
+	f.value, f.err = fn()
+	if f.err == nil {
+		c.Set(key, f.value)
+	}
+	return f.value, f.err
+}
+
+// Increment adds delta to the int64 value of key and returns the new value.
+// If key is not in the cache it's set to delta. It fails if the value is not an int64.
+func (c *Cache) Increment(key string, delta int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := delta
+	if entry, found := c.m[key]; found && !entry.expired(time.Now()) {
+		v, ok := entry.value.(int64)
+		if !ok {
+			return 0, fmt.Errorf("%q: value is %T, not int64", key, entry.value)
+		}
+		n += v
+	}
+
+	c.set(key, n)
+	return n, nil
+}
+
+// set sets key to value, c.mu must be held.
+func (c *Cache) set(key string, value any) {
+	size := c.sizer(value)
+
+	// if exists, update value and expiration, the update counts as a use
+	if old, found := c.m[key]; found {
+		entry := Entry{
 			value:      value,
-			expiration: time.Now().Add(c.ttl),
+			expiration: c.expiration(),
+			size:       size,
+			uses:       old.uses,
 		}
+		c.m[key] = entry
+		c.used(key, entry)
+		c.bytes += size - old.size
+		c.evictBytes()
 		return
 	}
 
-	// if full, evict oldest
+	// if full, evict according to policy
 	if len(c.m) >= c.size {
-		oldest := c.keys[0]
-		delete(c.m, oldest)
-		c.keys = c.keys[1:]
+		c.evict()
 	}
 
 	c.m[key] = Entry{
 		value:      value,
-		expiration: time.Now().Add(c.ttl),
+		expiration: c.expiration(),
+		size:       size,
 	}
 	c.keys = append(c.keys, key)
+	c.bytes += size
+	c.evictBytes()
+}
+
+// Touch resets the expiration of key, as if it was just set, without reading its value.
+// It returns false if key is not in the cache or expired.
+func (c *Cache) Touch(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.m[key]
+	if !found || entry.expired(time.Now()) {
+		return false
+	}
+	entry.expiration = c.expiration()
+	c.m[key] = entry
+	return true
+}
+
+// Delete removes key from the cache.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.m[key]
+	if !found {
+		return
+	}
+	delete(c.m, key)
+	c.removeKey(key)
+	c.bytes -= entry.size
+}
+
+// Clear removes all entries from the cache.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.m)
+	c.keys = nil
+	c.bytes = 0
+}
+
+// TTL returns how long key has left to live, or NoExpiration if it never expires.
+// It returns false if key is not in the cache or expired.
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.m[key]
+	now := time.Now()
+	if !found || entry.expired(now) {
+		return 0, false
+	}
+	if entry.expiration.IsZero() {
+		return NoExpiration, true
+	}
+	return entry.expiration.Sub(now), true
+}
+
+// expiration returns the expiration time for a new entry.
+func (c *Cache) expiration() time.Time {
+	if c.ttl == 0 {
+		return time.Time{}
+	}
+
+	ttl := c.ttl
+	if c.jitter > 0 {
+		ttl += time.Duration((rand.Float64()*2 - 1) * c.jitter * float64(c.ttl))
+	}
+	return time.Now().Add(ttl)
+}
+
+// evicted counts the eviction, or expiration if expired, and calls onEvict, if set.
+// c.mu must be held.
+func (c *Cache) evicted(key string, entry Entry, expired bool) {
+	if expired {
+		c.expirations.Add(1)
+	} else {
+		c.evictions.Add(1)
+	}
+	if c.onEvict != nil {
+		c.onEvict(key, entry.value)
+	}
+}
+
+// evict removes the entry chosen by the policy, c.mu must be held.
+func (c *Cache) evict() {
+	i := 0 // FIFO and LRU keep keys in eviction order
+	if c.policy == LFU {
+		for j, k := range c.keys {
+			if c.m[k].uses < c.m[c.keys[i]].uses {
+				i = j
+			}
+		}
+	}
+
+	key := c.keys[i]
+	entry := c.m[key]
+	c.bytes -= entry.size
+	delete(c.m, key)
+	if i == 0 {
+		c.keys = c.keys[1:]
+	} else {
+		c.keys = append(c.keys[:i], c.keys[i+1:]...)
+	}
+	c.evicted(key, entry, false)
+}
+
+// evictBytes evicts entries until the cache is within maxBytes, c.mu must be held.
+func (c *Cache) evictBytes() {
+	for c.maxBytes > 0 && c.bytes > c.maxBytes && len(c.keys) > 0 {
+		c.evict()
+	}
+}
+
+// Len returns the number of entries in the cache, including expired ones that weren't
+// removed yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.m)
 }
 
 func (c *Cache) Keys() []string {
@@ -101,6 +604,55 @@ func (c *Cache) Keys() []string {
 	return keys
 }
 
+// Range calls fn for every live (unexpired) entry, in eviction order, stopping if fn returns
+// false. Like sync.Map.Range, but fn is called with the cache locked and must not call
+// any Cache method, otherwise it will deadlock.
+func (c *Cache) Range(fn func(key string, value any) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range c.keys {
+		entry, found := c.m[k]
+		if !found || entry.expired(now) {
+			continue
+		}
+		if !fn(k, entry.value) {
+			return
+		}
+	}
+}
+
+// Oldest returns the first live key in eviction order, the one evicted next with FIFO
+// and LRU. With LFU it's the least recently added.
+func (c *Cache) Oldest() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range c.keys {
+		if !c.m[k].expired(now) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Newest returns the last live key in eviction order, the one added (FIFO, LFU) or
+// used (LRU) last.
+func (c *Cache) Newest() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for i := len(c.keys) - 1; i >= 0; i-- {
+		if k := c.keys[i]; !c.m[k].expired(now) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
 func (c *Cache) removeKey(key string) {
 	for i, k := range c.keys {
 		if k == key {
@@ -117,7 +669,7 @@ func main() {
 	size := 5
 	ttl := 10 * time.Millisecond
 	log.Printf("info: creating cache: size=%d, ttl=%v", size, ttl)
-	c, err := New(size, ttl)
+	c, err := New(WithSize(size), WithTTL(ttl))
 	if err != nil {
 		log.Printf("error: can't create - %s", err)
 		return
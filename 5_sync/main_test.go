@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCache(t *testing.T, opts ...Option) *Cache {
+	t.Helper()
+	c, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestMaxBytes(t *testing.T) {
+	c := newCache(t, WithSize(100), WithMaxBytes(10))
+	c.Set("a", "12345")
+	c.Set("b", "12345")
+	c.Set("c", "1")
+
+	if c.Has("a") {
+		t.Fatal("a not evicted")
+	}
+	if !c.Has("b") || !c.Has("c") {
+		t.Fatalf("keys = %v, want [b c]", c.Keys())
+	}
+	if s := c.Stats(); s.Evictions != 1 {
+		t.Fatalf("evictions = %d, want 1", s.Evictions)
+	}
+}
+
+func TestMaxBytesSizer(t *testing.T) {
+	sizer := func(value any) int64 { return value.(int64) }
+	c := newCache(t, WithSize(100), WithMaxBytes(10), WithSizer(sizer))
+	c.Set("a", int64(4))
+	c.Set("b", int64(4))
+	c.Set("b", int64(7)) // update grows b over the limit
+
+	if c.Has("a") || !c.Has("b") {
+		t.Fatalf("keys = %v, want [b]", c.Keys())
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	ttl := time.Hour
+	c := newCache(t, WithSize(100), WithTTL(ttl), WithTTLJitter(0.5))
+
+	seen := make(map[time.Duration]bool)
+	for i := range 100 {
+		key := string(rune('a' + i))
+		c.Set(key, i)
+		d, _ := c.TTL(key)
+		if d < ttl/2-time.Second || d > ttl+ttl/2 {
+			t.Fatalf("TTL %v out of range", d)
+		}
+		seen[d.Round(time.Minute)] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("TTLs are not spread")
+	}
+}
+
+func TestRange(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	for _, k := range []string{"a", "b", "c"} {
+		c.Set(k, k)
+	}
+
+	var keys []string
+	c.Range(func(key string, value any) bool {
+		keys = append(keys, key)
+		return key != "b"
+	})
+	if want := []string{"a", "b"}; !slices.Equal(keys, want) {
+		t.Fatalf("keys = %v, want %v", keys, want)
+	}
+}
+
+func TestHas(t *testing.T) {
+	c := newCache(t, WithSize(2), WithPolicy(LRU))
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	if !c.Has("a") || c.Has("z") {
+		t.Fatal("bad Has")
+	}
+	c.Set("c", 3) // Has didn't make a recently used
+	if c.Has("a") {
+		t.Fatal("a not evicted")
+	}
+	if s := c.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Fatalf("Has changed stats: %+v", s)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"no size", nil},
+		{"negative ttl", []Option{WithSize(1), WithTTL(-time.Second)}},
+		{"negative cleanup", []Option{WithSize(1), WithCleanupInterval(-time.Second)}},
+		{"negative max bytes", []Option{WithSize(1), WithMaxBytes(-1)}},
+		{"nil sizer", []Option{WithSize(1), WithSizer(nil)}},
+		{"jitter too big", []Option{WithSize(1), WithTTLJitter(1)}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(tc.opts...); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestNoExpiration(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	c.Set("a", 1)
+
+	ttl, ok := c.TTL("a")
+	if !ok || ttl != NoExpiration {
+		t.Fatalf("TTL = %v, %v, want NoExpiration", ttl, ok)
+	}
+}
+
+func TestOldestNewest(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	if _, ok := c.Oldest(); ok {
+		t.Fatal("Oldest of empty cache")
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	if k, _ := c.Oldest(); k != "a" {
+		t.Fatalf("oldest = %q, want a", k)
+	}
+	if k, _ := c.Newest(); k != "c" {
+		t.Fatalf("newest = %q, want c", k)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c := newCache(t, WithSize(10), WithTTL(30*time.Millisecond))
+	c.Set("a", 1)
+
+	time.Sleep(20 * time.Millisecond)
+	if !c.Touch("a") {
+		t.Fatal("Touch failed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !c.Has("a") {
+		t.Fatal("touched entry expired")
+	}
+	if c.Touch("z") {
+		t.Fatal("touched missing key")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	c := newCache(t, WithSize(10))
+
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Increment("n", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := c.Get("n"); v != int64(100) {
+		t.Fatalf("n = %v, want 100", v)
+	}
+
+	c.Set("s", "x")
+	if _, err := c.Increment("s", 1); err == nil {
+		t.Fatal("incremented a string")
+	}
+}
+
+func TestSetAsync(t *testing.T) {
+	c := newCache(t, WithSize(1000))
+	for i := range 100 {
+		c.SetAsync(string(rune('a'+i)), i)
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.Len() < 100 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.Len() != 100 {
+		t.Fatalf("len = %d, want 100", c.Len())
+	}
+}
+
+func TestSetAsyncAfterClose(t *testing.T) {
+	c, err := New(WithSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.SetAsync("a", 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetAsync blocked after Close")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g := NewGroup(WithSize(10))
+	defer g.Close()
+
+	users, err := g.Cache("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	movies, err := g.Cache("movies", WithSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := g.Cache("users"); again != users {
+		t.Fatal("Cache returned a new cache for an existing name")
+	}
+
+	users.Set("k", "user")
+	movies.Set("k", "movie")
+	if v, _ := users.Get("k"); v != "user" {
+		t.Fatalf("users k = %v", v)
+	}
+	movies.Get("z")
+
+	if s := g.Stats(); s.Hits != 1 || s.Misses != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+	g.Clear()
+	if users.Len() != 0 || movies.Len() != 0 {
+		t.Fatal("Clear didn't clear")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+
+	c := newCache(t, WithSize(5), WithTTL(time.Hour))
+	c.Set("a", "1")
+	c.Set("b", 2)
+	if err := c.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+
+	if want := []string{"a", "b"}; !slices.Equal(loaded.Keys(), want) {
+		t.Fatalf("keys = %v, want %v", loaded.Keys(), want)
+	}
+	if v, _ := loaded.Get("b"); v != 2 {
+		t.Fatalf("b = %v, want 2", v)
+	}
+	if ttl, _ := loaded.TTL("a"); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("a TTL = %v", ttl)
+	}
+
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+}
+
+func TestSaveKeepsOldFileOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+
+	c := newCache(t, WithSize(5))
+	c.Set("a", "1")
+	if err := c.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("f", func() {}) // functions can't be encoded
+	if err := c.SaveToFile(path); err == nil {
+		t.Fatal("saved a func")
+	}
+
+	loaded, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("previous file damaged: %v", err)
+	}
+	defer loaded.Close()
+	if !loaded.Has("a") {
+		t.Fatal("previous entries lost")
+	}
+
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	// a, b and c are added in order, then a is read twice and b once before d
+	// makes room: FIFO evicts a, LRU evicts c and LFU evicts c
+	tests := []struct {
+		policy  Policy
+		evicted string
+	}{
+		{FIFO, "a"},
+		{LRU, "c"},
+		{LFU, "c"},
+	}
+
+	for _, tc := range tests {
+		c := newCache(t, WithSize(3), WithPolicy(tc.policy))
+		for _, k := range []string{"a", "b", "c"} {
+			c.Set(k, k)
+		}
+		c.Get("a")
+		c.Get("b")
+		c.Get("a")
+		c.Set("d", "d")
+
+		if c.Has(tc.evicted) {
+			t.Errorf("policy %d: %q not evicted, keys: %v", tc.policy, tc.evicted, c.Keys())
+		}
+		if c.Len() != 3 {
+			t.Errorf("policy %d: len = %d, want 3", tc.policy, c.Len())
+		}
+	}
+
+	if _, err := New(WithSize(1), WithPolicy(LFU+1)); err == nil {
+		t.Fatal("no error for an unknown policy")
+	}
+}
+
+func TestLRUOrder(t *testing.T) {
+	c := newCache(t, WithSize(2), WithPolicy(LRU))
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+
+	if want := []string{"a", "c"}; !slices.Equal(c.Keys(), want) {
+		t.Fatalf("keys = %v, want %v", c.Keys(), want)
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	c := newCache(t, WithSize(10))
+
+	var calls atomic.Int64
+	start := make(chan struct{})
+	fn := func() (any, error) {
+		calls.Add(1)
+		<-start
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrCompute("k", fn)
+			if err != nil || v != 42 {
+				t.Errorf("got %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("fn called %d times, want 1", n)
+	}
+}
+
+func TestGetOrComputeError(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	errBoom := errors.New("boom")
+
+	_, err := c.GetOrCompute("k", func() (any, error) { return nil, errBoom })
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("err = %v, want %v", err, errBoom)
+	}
+	if c.Has("k") {
+		t.Fatal("error cached")
+	}
+}
+
+func TestGetOrComputePanic(t *testing.T) {
+	c := newCache(t, WithSize(10))
+
+	started := make(chan struct{})
+	waiterErr := make(chan error, 1)
+	go func() {
+		<-started
+		_, err := c.GetOrCompute("k", func() (any, error) { return 1, nil })
+		waiterErr <- err
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic not propagated")
+			}
+		}()
+		c.GetOrCompute("k", func() (any, error) {
+			close(started)
+			time.Sleep(20 * time.Millisecond) // let the waiter join
+			panic("boom")
+		})
+	}()
+
+	if err := <-waiterErr; err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("waiter err = %v, want a panic error", err)
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	var calls atomic.Int64
+	square := Memoize(func(n int) (int, error) {
+		calls.Add(1)
+		return n * n, nil
+	}, 10, 0)
+
+	for range 3 {
+		if v, err := square(4); err != nil || v != 16 {
+			t.Fatalf("square(4) = %v, %v", v, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("fn called %d times, want 1", n)
+	}
+}
+
+func TestMemoizeInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic with size 0")
+		}
+	}()
+	Memoize(func(n int) (int, error) { return n, nil }, 0, 0)
+}
+
+func TestPersistPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+
+	c, err := New(WithSize(5), WithPersistPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", "1")
+	c.Close()
+
+	c = newCache(t, WithSize(5), WithPersistPath(path))
+	if v, _ := c.Get("a"); v != "1" {
+		t.Fatalf("a = %v, want 1", v)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	c := newCache(t, WithSize(1))
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("b")
+	c.Get("a")
+
+	var sb strings.Builder
+	if err := c.WriteMetrics(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"cache_hits_total 1",
+		"cache_misses_total 1",
+		"cache_evictions_total 1",
+		"cache_entries 1",
+		"# TYPE cache_entries gauge",
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, sb.String())
+		}
+	}
+}
+
+func TestScoped(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	c.Set("global", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := c.Scoped(ctx)
+	s.Set("scoped", 2)
+	if v, ok := s.Get("scoped"); !ok || v != 2 {
+		t.Fatalf("scoped = %v, %v", v, ok)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for c.Has("scoped") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.Has("scoped") {
+		t.Fatal("scoped key not deleted")
+	}
+	if !c.Has("global") {
+		t.Fatal("global key deleted")
+	}
+
+	s.Set("late", 3)
+	if c.Has("late") {
+		t.Fatal("set after the scope ended")
+	}
+}
+
+func TestScopedRelease(t *testing.T) {
+	c := newCache(t, WithSize(10))
+	s := c.Scoped(context.Background())
+	s.Set("a", 1)
+	s.Release()
+
+	if c.Has("a") {
+		t.Fatal("key not deleted by Release")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := newCache(t, WithSize(10), WithTTL(20*time.Millisecond))
+	c.Set("a", 1)
+
+	if ttl, ok := c.TTL("a"); !ok || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Fatalf("TTL = %v, %v", ttl, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("got expired entry")
+	}
+
+	s := c.Stats()
+	if s.Expirations != 1 || s.Evictions != 0 || s.Misses != 1 {
+		t.Fatalf("stats = %+v, want 1 expiration and 1 miss", s)
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	var evicted atomic.Int64
+	onEvict := func(string, any) { evicted.Add(1) }
+	c := newCache(t, WithSize(10), WithTTL(10*time.Millisecond), WithCleanupInterval(5*time.Millisecond), WithOnEvict(onEvict))
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	deadline := time.Now().Add(time.Second)
+	for c.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("len = %d, want 0", c.Len())
+	}
+	if n := evicted.Load(); n != 2 {
+		t.Fatalf("onEvict called %d times, want 2", n)
+	}
+	if n := c.Stats().Expirations; n != 2 {
+		t.Fatalf("expirations = %d, want 2", n)
+	}
+}
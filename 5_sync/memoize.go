@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Memoize returns fn with its results cached in a Cache of size entries that live for ttl
+// (0 means forever). Concurrent calls with the same missing argument call fn once, see
+// GetOrCompute. Arguments are keyed by their %#v rendering, so distinct arguments must
+// render differently. Errors are not cached.
+// Memoize panics if size or ttl are invalid, see New.
+func Memoize[K comparable, V any](fn func(K) (V, error), size int, ttl time.Duration) func(K) (V, error) {
+	c, err := New(WithSize(size), WithTTL(ttl))
+	if err != nil {
+		panic(fmt.Sprintf("memoize: %s", err))
+	}
+
+	return func(k K) (V, error) {
+		v, err := c.GetOrCompute(fmt.Sprintf("%#v", k), func() (any, error) {
+			return fn(k)
+		})
+		if err != nil {
+			var zero V
+			return zero, err
+		}
+		val, _ := v.(V) // a nil interface V is cached as nil
+		return val, nil
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// WriteMetrics writes the cache stats and size to w in the Prometheus text exposition
+// format. Counters are read atomically, the cache is locked only to get its length.
+func (c *Cache) WriteMetrics(w io.Writer) error {
+	s := c.Stats()
+	metrics := []struct {
+		name, help, typ string
+		value           int64
+	}{
+		{"cache_hits_total", "Number of Get calls that found the key.", "counter", s.Hits},
+		{"cache_misses_total", "Number of Get calls that didn't find the key.", "counter", s.Misses},
+		{"cache_evictions_total", "Number of entries evicted to make room.", "counter", s.Evictions},
+		{"cache_expirations_total", "Number of entries removed because they expired.", "counter", s.Expirations},
+		{"cache_entries", "Number of entries in the cache.", "gauge", int64(c.Len())},
+	}
+
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the on disk format of a cache.
+type snapshot struct {
+	Size    int
+	TTL     time.Duration
+	SavedAt time.Time
+	Entries []savedEntry // oldest first
+}
+
+type savedEntry struct {
+	Key   string
+	Value any
+	TTL   time.Duration // remaining, NoExpiration if it never expires
+}
+
+// SaveToFile writes the size, TTL and live entries of the cache to path, in gob format.
+// path is replaced atomically, on error the previous file is left as it was.
+// Values are encoded as interfaces, so their concrete types must be gob encodable and,
+// except for basic types, registered with gob.Register before saving and loading.
+func (c *Cache) SaveToFile(path string) error {
+	snap := snapshot{Size: c.size, TTL: c.ttl}
+
+	c.mu.Lock()
+	now := time.Now()
+	snap.SavedAt = now
+	for _, k := range c.keys {
+		entry := c.m[k]
+		if entry.expired(now) {
+			continue
+		}
+		ttl := NoExpiration
+		if !entry.expiration.IsZero() {
+			ttl = entry.expiration.Sub(now)
+		}
+		snap.Entries = append(snap.Entries, savedEntry{Key: k, Value: entry.value, TTL: ttl})
+	}
+	c.mu.Unlock()
+
+	return writeSnapshot(path, snap)
+}
+
+// LoadFromFile returns a cache with the entries saved to path by SaveToFile, minus the
+// ones that expired since: the time between the save and the load counts toward
+// expiration. The cache has the saved size and TTL unless overridden by opts.
+func LoadFromFile(path string, opts ...Option) (*Cache, error) {
+	snap, err := readSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]Option{WithSize(snap.Size), WithTTL(snap.TTL)}, opts...)
+	c, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.restore(snap)
+	return c, nil
+}
+
+// WithPersistPath makes New load the entries saved in path, if it exists, and Close save
+// them back, see SaveToFile. A file that can't be loaded is logged and the cache starts
+// empty.
+func WithPersistPath(path string) Option {
+	return func(c *Cache) {
+		c.persistPath = path
+	}
+}
+
+// load restores the entries saved in c.persistPath.
+func (c *Cache) load() {
+	snap, err := readSnapshot(c.persistPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return
+	case err != nil:
+		log.Printf("warn: %q: can't load cache - %s", c.persistPath, err)
+		return
+	}
+	c.restore(snap)
+}
+
+// readSnapshot reads the snapshot saved in path.
+func readSnapshot(path string) (snapshot, error) {
+	var snap snapshot
+	file, err := os.Open(path)
+	if err != nil {
+		return snap, err
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&snap)
+	return snap, err
+}
+
+// writeSnapshot saves snap to path. It is encoded to a hidden file in the same
+// directory first and renamed over path once complete, so readers only ever see a
+// whole snapshot; on error the hidden file is removed.
+func writeSnapshot(path string, snap snapshot) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if err := gob.NewEncoder(file).Encode(snap); err != nil {
+		return err
+	}
+	// a snapshot is as readable as a file made by os.Create, not owner only
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// restore sets the entries of snap that are not expired.
+func (c *Cache) restore(snap snapshot) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range snap.Entries {
+		var expiration time.Time
+		if e.TTL != NoExpiration {
+			expiration = snap.SavedAt.Add(e.TTL)
+			if !expiration.After(now) { // expired while saved
+				continue
+			}
+		}
+
+		c.set(e.Key, e.Value)
+		if entry, found := c.m[e.Key]; found { // set may evict it if too big
+			entry.expiration = expiration
+			c.m[e.Key] = entry
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ScopedCache sets keys in a Cache for the lifetime of a context, see Cache.Scoped.
+type ScopedCache struct {
+	c       *Cache
+	release chan struct{} // closed by Release
+	once    sync.Once
+
+	mu    sync.Mutex
+	keys  map[string]bool
+	ended bool
+}
+
+// Scoped returns a scope whose keys are deleted from c once ctx is done or Release is
+// called, whichever comes first. Keys are shared with c, so a key set through the scope
+// is deleted even if it was set again directly in c meanwhile.
+func (c *Cache) Scoped(ctx context.Context) *ScopedCache {
+	s := &ScopedCache{
+		c:       c,
+		release: make(chan struct{}),
+		keys:    make(map[string]bool),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.release:
+		}
+		s.end()
+	}()
+	return s
+}
+
+// Set sets key to value in the cache, until the scope ends. It does nothing if the scope
+// already ended.
+func (s *ScopedCache) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.keys[key] = true
+	s.c.Set(key, value)
+}
+
+// Get is Cache.Get.
+func (s *ScopedCache) Get(key string) (any, bool) {
+	return s.c.Get(key)
+}
+
+// Release ends the scope, deleting its keys, and stops watching the context.
+// It returns once the keys are deleted.
+func (s *ScopedCache) Release() {
+	s.once.Do(func() { close(s.release) })
+	s.end()
+}
+
+// end deletes the keys of the scope, once.
+func (s *ScopedCache) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	for key := range s.keys {
+		s.c.Delete(key)
+	}
+	s.keys = nil
+}